@@ -1,43 +1,295 @@
 package config
 
 import (
+	"bytes"
+	"fmt"
 	"net/url"
 	"os"
+	"regexp"
+	"strings"
+	"text/template"
 	"time"
 
+	"github.com/robfig/cron/v3"
 	"github.com/spf13/viper"
 )
 
 var Version string
 
+var nonAlfaChars = regexp.MustCompile("[^a-zA-Z0-9]")
+
+// Reductions available for turning range vector (matrix) results into a single value
+const (
+	ReduceLast = "last"
+	ReduceMin  = "min"
+	ReduceMax  = "max"
+	ReduceAvg  = "avg"
+	ReduceSum  = "sum"
+	// ReduceJSON will publish all the points as JSON array of [timestamp, "value"] pairs
+	ReduceJSON = "json"
+)
+
+// Payload formats of simple publisher
+const (
+	// PayloadRaw will publish just the value
+	PayloadRaw = "raw"
+	// PayloadJSON will publish JSON with the value, timestamp, name, labels and query
+	PayloadJSON = "json"
+)
+
+// HomeAssistant components supported for metrics
+const (
+	ComponentSensor       = "sensor"
+	ComponentBinarySensor = "binary_sensor"
+	ComponentEvent        = "event"
+	ComponentText         = "text"
+)
+
 type Metric struct {
-	Name  string `mapstructure:"name"`
-	Query string `mapstructure:"query"`
+	// ID is the stable identifier of the metric, so its Name can change without creating new HomeAssistant entity.
+	// Defaults to the Name and can contain the same template actions.
+	ID string `mapstructure:"id"`
+	// Name can contain Go template actions referencing series labels, e.g. "disk_free/{{.device}}"
+	Name string `mapstructure:"name"`
+	// MultiSeries will append the values of series labels to the name and ID when it has no template actions,
+	// so every series returned by the query gets its own topic and entity
+	MultiSeries bool   `mapstructure:"multi_series"`
+	Query       string `mapstructure:"query"`
+	// Source is the name of the data source the query is sent to, the one from prometheus_url by default
+	Source string `mapstructure:"source"`
+	// Reduce defines how range vector results are turned into a single value
+	Reduce string `mapstructure:"reduce"`
+	// Range will make the query a range query covering given duration until now
+	Range time.Duration `mapstructure:"range"`
+	Step  time.Duration `mapstructure:"step"`
+	// Timeout overrides global ScrapeTimeout for this metric
+	Timeout time.Duration `mapstructure:"timeout"`
+	// Interval overrides global Interval for this metric
+	Interval time.Duration `mapstructure:"interval"`
+	// Cron schedules the metric at wall-clock times instead of the interval, e.g. "* * * * *" for every full minute
+	Cron string `mapstructure:"cron"`
+	// OnlyOnChange will publish the value only when it differs from previously published one
+	OnlyOnChange bool `mapstructure:"only_on_change"`
+	// Deadband is the absolute change of numeric value, which is still not considered as a change
+	Deadband float64 `mapstructure:"deadband"`
+	// DeadbandPercent is the change relative to previously published value, which is still not considered as a change
+	DeadbandPercent float64 `mapstructure:"deadband_percent"`
+	// MaxSilence will force publishing unchanged value when the last publish is older than that
+	MaxSilence time.Duration `mapstructure:"max_silence"`
+	// Availability will publish "offline" on the metric availability topic when the query fails or returns no data
+	Availability bool `mapstructure:"availability"`
+	// Topic is Go template of the topic for this metric, overriding Mqtt.TopicTemplate
+	Topic string `mapstructure:"topic"`
+	// HomeAssistant holds the attributes of the entity sent in HomeAssistant discovery message
+	HomeAssistant HomeAssistant `mapstructure:"home_assistant"`
+}
+
+// HomeAssistant holds the entity attributes of HomeAssistant MQTT discovery
+type HomeAssistant struct {
+	UnitOfMeasurement         string        `mapstructure:"unit_of_measurement"`
+	DeviceClass               string        `mapstructure:"device_class"`
+	StateClass                string        `mapstructure:"state_class"`
+	Icon                      string        `mapstructure:"icon"`
+	ExpireAfter               time.Duration `mapstructure:"expire_after"`
+	ForceUpdate               bool          `mapstructure:"force_update"`
+	SuggestedDisplayPrecision *int          `mapstructure:"suggested_display_precision"`
+	EntityCategory            string        `mapstructure:"entity_category"`
+	ValueTemplate             string        `mapstructure:"value_template"`
+	// Device is the ID of configured device, which the entity belongs to
+	Device string `mapstructure:"device"`
+	// Component is HomeAssistant MQTT component of the entity, "sensor" by default
+	Component  string `mapstructure:"component"`
+	PayloadOn  string `mapstructure:"payload_on"`
+	PayloadOff string `mapstructure:"payload_off"`
+	// Threshold above which numeric value is mapped to PayloadOn for binary_sensor and event components
+	Threshold  *float64 `mapstructure:"threshold"`
+	EventTypes []string `mapstructure:"event_types"`
+}
+
+// GetComponent will return HomeAssistant component of the entity, "sensor" by default
+func (h HomeAssistant) GetComponent() string {
+	if h.Component == "" {
+		return ComponentSensor
+	}
+
+	return h.Component
+}
+
+// GetPayloadOn will return the payload of "on" state, "ON" by default
+func (h HomeAssistant) GetPayloadOn() string {
+	if h.PayloadOn == "" {
+		return "ON"
+	}
+
+	return h.PayloadOn
+}
+
+// GetPayloadOff will return the payload of "off" state, "OFF" by default
+func (h HomeAssistant) GetPayloadOff() string {
+	if h.PayloadOff == "" {
+		return "OFF"
+	}
+
+	return h.PayloadOff
+}
+
+// GetInterval will return the interval of scraping, defaulting to given global interval
+func (m Metric) GetInterval(defaultInterval time.Duration) time.Duration {
+	if m.Interval > 0 {
+		return m.Interval
+	}
+
+	return defaultInterval
+}
+
+// GetSource will return the name of the data source of the metric
+func (m Metric) GetSource() string {
+	if m.Source == "" {
+		return DefaultSource
+	}
+
+	return m.Source
+}
+
+// GetTimeout will return the timeout of the query, defaulting to given global timeout
+func (m Metric) GetTimeout(defaultTimeout time.Duration) time.Duration {
+	if m.Timeout > 0 {
+		return m.Timeout
+	}
+
+	return defaultTimeout
+}
+
+// GetStep will return the resolution of range query, 1/60 of the range by default
+func (m Metric) GetStep() time.Duration {
+	if m.Step > 0 {
+		return m.Step
+	}
+
+	step := m.Range / 60
+	if step < time.Second {
+		return time.Second
+	}
+
+	return step
+}
+
+// GetReduce will return the reduction for range vector results, "last" by default
+func (m Metric) GetReduce() string {
+	if m.Reduce == "" {
+		return ReduceLast
+	}
+
+	return m.Reduce
+}
+
+// GetID will return the ID of the metric, which is the Name by default
+func (m Metric) GetID() string {
+	if m.ID == "" {
+		return m.Name
+	}
+
+	return m.ID
+}
+
+// BaseName will return the Name without any template actions, used for topics related to the metric as a whole
+func (m Metric) BaseName() string {
+	return stripTemplate(m.Name)
+}
+
+// BaseID will return the ID without any template actions
+func (m Metric) BaseID() string {
+	return stripTemplate(m.GetID())
+}
+
+// IsNameTemplate will return true if the Name should be rendered with series labels
+func (m Metric) IsNameTemplate() bool {
+	return strings.Contains(m.Name, "{{")
+}
+
+// stripTemplate will return the part before the first template action,
+// or the whole template slugged when it starts with an action, so metric level topics never have empty levels
+func stripTemplate(s string) string {
+	i := strings.Index(s, "{{")
+	if i < 0 {
+		return s
+	}
+
+	if base := strings.Trim(s[:i], "/_- "); base != "" {
+		return base
+	}
+
+	return Slug(s)
 }
 
 type Config struct {
-	PrometheusUrl string        `mapstructure:"prometheus_url" envconfig:"prometheus_url" required:"true"`
+	PrometheusUrl string     `mapstructure:"prometheus_url" envconfig:"prometheus_url" required:"true"`
+	Prometheus    Prometheus `mapstructure:"prometheus" envconfig:"prometheus"`
+	// Sources are additional named data sources, metrics without source use the one from prometheus_url
+	Sources       []Source      `mapstructure:"sources" envconfig:"sources"`
 	Mqtt          Mqtt          `mapstructure:"mqtt" envconfig:"mqtt"`
 	Metrics       []Metric      `mapstructure:"metrics" envconfig:"metrics" default:"disks_flushes:node_disk_flush_requests_total{device='sda'}"`
 	Interval      time.Duration `mapstructure:"interval" envconfig:"interval" default:"15s"`
 	ScrapeTimeout time.Duration `mapstructure:"scrape_timeout" envconfig:"scrape_timeout" default:"3s"`
+	// Concurrency limits how many queries are running at the same time
+	Concurrency int `mapstructure:"concurrency" envconfig:"concurrency" default:"4"`
+	// Jitter is the maximum random delay added to every scheduled scrape
+	Jitter time.Duration `mapstructure:"jitter" envconfig:"jitter" default:"0s"`
+	// WarningsAsErrors will treat query results with warnings (e.g. partial data) as failed
+	WarningsAsErrors bool `mapstructure:"warnings_as_errors" envconfig:"warnings_as_errors" default:"false"`
 }
 
 type Mqtt struct {
-	User               string        `mapstructure:"user" envconfig:"user"`
-	Password           string        `mapstructure:"password" envconfig:"password"`
-	UserFile           string        `mapstructure:"user_file" envconfig:"user_file"`
-	PasswordFile       string        `mapstructure:"password_file" envconfig:"password_file"`
-	Servers            []string      `mapstructure:"servers" envconfig:"servers" required:"true"`
-	InsecureSkipVerify bool          `mapstructure:"insecure_skip_verify" envconfig:"insecure_skip_verify" default:"false"`
+	User               string   `mapstructure:"user" envconfig:"user"`
+	Password           string   `mapstructure:"password" envconfig:"password"`
+	UserFile           string   `mapstructure:"user_file" envconfig:"user_file"`
+	PasswordFile       string   `mapstructure:"password_file" envconfig:"password_file"`
+	Servers            []string `mapstructure:"servers" envconfig:"servers" required:"true"`
+	TLS                `mapstructure:",squash"`
 	PublishTopicPrefix string        `mapstructure:"publish_topic_prefix" envconfig:"publish_topic_prefix" default:"p2m"`
 	ClientID           string        `mapstructure:"client_id" envconfig:"client_id" default:"Prometheus2MQTT"`
 	RetainMessages     bool          `mapstructure:"retain_messages" envconfig:"retain_messages" default:"true"`
 	PublishTimeout     time.Duration `mapstructure:"publish_timeout" envconfig:"publish_timeout" default:"5s"`
 	Qos                byte          `mapstructure:"qos" envconfig:"qos" default:"1"`
+	// TopicTemplate is Go template of the topic for all metrics, e.g. "home/{{.labels.room}}/{{.name}}"
+	TopicTemplate string `mapstructure:"topic_template" envconfig:"topic_template"`
+	// Snapshot will publish current values of all the metrics as single message after every scrape
+	Snapshot bool `mapstructure:"snapshot" envconfig:"snapshot" default:"false"`
+	// PayloadFormat of values sent by simple publisher, "raw" or "json"
+	PayloadFormat string `mapstructure:"payload_format" envconfig:"payload_format" default:"raw"`
 	// HAPublisher defines if MQTT publishing format should be compatible with HomeAssistant
 	HAPublisher     bool   `mapstructure:"ha_publisher" envconfig:"ha_publisher" default:"true"`
 	DiscoveryPrefix string `mapstructure:"discovery_prefix" envconfig:"discovery_prefix" default:"homeassistant"`
+	// HAJSONAttributes will publish labels, timestamp and query of every sample as HomeAssistant entity attributes
+	HAJSONAttributes bool `mapstructure:"ha_json_attributes" envconfig:"ha_json_attributes" default:"false"`
+	// HADeviceDiscovery will announce all the entities of a device with single device discovery message
+	HADeviceDiscovery bool `mapstructure:"ha_device_discovery" envconfig:"ha_device_discovery" default:"false"`
+	// Devices are HomeAssistant devices, which the metrics can be assigned to
+	Devices []Device `mapstructure:"devices" envconfig:"devices"`
+}
+
+// Device is HomeAssistant device grouping the entities of metrics.
+// All the fields can contain Go template actions referencing series labels, e.g. "node_{{.instance}}",
+// so a single definition creates separate device for every instance.
+type Device struct {
+	ID            string `mapstructure:"id"`
+	Name          string `mapstructure:"name"`
+	Model         string `mapstructure:"model"`
+	Manufacturer  string `mapstructure:"manufacturer"`
+	SuggestedArea string `mapstructure:"suggested_area"`
+	// ViaDevice is the ID of the device, through which this device is connected
+	ViaDevice string `mapstructure:"via_device"`
+}
+
+// Device will return the configured device with given ID
+func (m Mqtt) Device(id string) (Device, bool) {
+	for _, d := range m.Devices {
+		if d.ID == id {
+			return d, true
+		}
+	}
+
+	return Device{}, false
 }
 
 func (m Mqtt) ServersUrls() ([]*url.URL, error) {
@@ -53,6 +305,42 @@ func (m Mqtt) ServersUrls() ([]*url.URL, error) {
 	return mqttServers, nil
 }
 
+// ObjectID will return HomeAssistant object ID of the metric with given ID.
+// It is used in the topics and as unique ID of the entity.
+func (m Mqtt) ObjectID(id string) string {
+	return Slug(m.ClientID + ": " + id)
+}
+
+// Slug will replace all non-alfanumeric characters with "_"
+func Slug(s string) string {
+	return strings.Trim(nonAlfaChars.ReplaceAllString(s, "_"), "_")
+}
+
+// NewTemplate will create Go template of names, IDs and topics rendered with series labels.
+// The slug function turns label values into valid topic levels, e.g. "disk_free/{{slug .device}}".
+func NewTemplate(name string) *template.Template {
+	return template.New(name).Funcs(template.FuncMap{"slug": Slug})
+}
+
+// ValidateTopic will check the topic can be used for publishing: it can not contain wildcards or empty levels
+func ValidateTopic(topic string) error {
+	if strings.ContainsAny(topic, "+#") {
+		return fmt.Errorf("topic %q contains wildcard", topic)
+	}
+	for _, level := range strings.Split(topic, "/") {
+		if level == "" {
+			return fmt.Errorf("topic %q contains empty level", topic)
+		}
+	}
+
+	return nil
+}
+
+// BridgeTopic will return the topic for messages about the bridge itself, e.g. its status
+func (m Mqtt) BridgeTopic(name string) string {
+	return m.PublishTopicPrefix + "/" + name
+}
+
 // GetUser will return the correct User value
 func (m Mqtt) GetUser() string {
 	if m.UserFile == "" {
@@ -89,11 +377,13 @@ func Load(file string) (Config, error) {
 
 	viper.SetDefault("interval", time.Second*15)
 	viper.SetDefault("scrape_timeout", time.Second*3)
-	viper.SetDefault("mqtt.public_topic_prefix", "p2m")
+	viper.SetDefault("concurrency", 4)
+	viper.SetDefault("mqtt.publish_topic_prefix", "p2m")
 	viper.SetDefault("mqtt.client_id", "Prometheus2MQTT")
 	viper.SetDefault("mqtt.retain_messages", true)
 	viper.SetDefault("mqtt.publish_timeout", time.Second*5)
 	viper.SetDefault("mqtt.qos", 1)
+	viper.SetDefault("mqtt.payload_format", PayloadRaw)
 	viper.SetDefault("mqtt.ha_publisher", true)
 	viper.SetDefault("mqtt.discovery_prefix", "homeassistant")
 
@@ -103,6 +393,183 @@ func Load(file string) (Config, error) {
 	}
 
 	err = viper.Unmarshal(&c)
+	if err != nil {
+		return c, err
+	}
+
+	return c, c.Validate()
+}
+
+// staticTopic will render the topic of the metric without series labels, so the metrics overwriting each other
+// are detected on startup. The second value is false when the topic is rendered from series labels
+// or the metric is published on HomeAssistant topics, which are checked with the object IDs.
+// Templated names and IDs are used as they are, series with different labels get different topics anyway.
+func (c Config) staticTopic(metric Metric) (string, bool, error) {
+	tpl := metric.Topic
+	if tpl == "" {
+		tpl = c.Mqtt.TopicTemplate
+	}
+	if tpl == "" {
+		return c.Mqtt.PublishTopicPrefix + "/" + metric.Name, !c.Mqtt.HAPublisher, nil
+	}
+	if strings.Contains(tpl, ".labels") {
+		return "", false, nil
+	}
+
+	t, err := NewTemplate(metric.Name).Option("missingkey=zero").Parse(tpl)
+	if err != nil {
+		return "", false, err
+	}
+	buf := bytes.Buffer{}
+	err = t.Execute(&buf, map[string]interface{}{
+		"name":      metric.Name,
+		"id":        metric.GetID(),
+		"client_id": c.Mqtt.ClientID,
+		"prefix":    c.Mqtt.PublishTopicPrefix,
+		"sub":       "",
+	})
+
+	return buf.String(), true, err
+}
+
+// Validate will check the metrics, so configuration mistakes are reported on startup
+func (c Config) Validate() error {
+	if c.Mqtt.PayloadFormat != PayloadRaw && c.Mqtt.PayloadFormat != PayloadJSON {
+		return fmt.Errorf("unknown payload_format %q", c.Mqtt.PayloadFormat)
+	}
+
+	err := c.validateSources()
+	if err != nil {
+		return err
+	}
+	err = c.validateDevices()
+	if err != nil {
+		return err
+	}
+	_, err = NewTemplate("topic_template").Parse(c.Mqtt.TopicTemplate)
+	if err != nil {
+		return fmt.Errorf("invalid topic_template: %w", err)
+	}
+
+	names := make(map[string]struct{}, len(c.Metrics))
+	objectIDs := make(map[string]string, len(c.Metrics))
+	topics := make(map[string]string, len(c.Metrics))
+	for _, metric := range c.Metrics {
+		if metric.Name == "" {
+			return fmt.Errorf("metric with query %q has no name", metric.Query)
+		}
+		if _, exists := names[metric.Name]; exists {
+			return fmt.Errorf("metric %s is configured more than once", metric.Name)
+		}
+		names[metric.Name] = struct{}{}
+
+		// the base ID is used by the error, diagnostics and availability topics of the metric
+		for _, objectID := range []string{c.Mqtt.ObjectID(metric.GetID()), c.Mqtt.ObjectID(metric.BaseID())} {
+			if other, exists := objectIDs[objectID]; exists && other != metric.Name {
+				return fmt.Errorf(
+					"metrics %s and %s would use the same topic and ID %s, set different id for one of them",
+					other,
+					metric.Name,
+					objectID,
+				)
+			}
+			objectIDs[objectID] = metric.Name
+		}
+
+		_, err = NewTemplate(metric.Name).Parse(metric.Name)
+		if err != nil {
+			return fmt.Errorf("invalid name of metric %s: %w", metric.Name, err)
+		}
+		switch metric.HomeAssistant.GetComponent() {
+		case ComponentSensor, ComponentBinarySensor, ComponentEvent, ComponentText:
+		default:
+			return fmt.Errorf("unknown component %q of metric %s", metric.HomeAssistant.Component, metric.Name)
+		}
+		if device := metric.HomeAssistant.Device; device != "" {
+			if _, exists := c.Mqtt.Device(device); !exists {
+				return fmt.Errorf("metric %s references unknown device %s", metric.Name, device)
+			}
+		}
+		_, err = NewTemplate(metric.GetID()).Parse(metric.GetID())
+		if err != nil {
+			return fmt.Errorf("invalid id of metric %s: %w", metric.Name, err)
+		}
+		// static ID gets the label values appended only with multi_series, otherwise every series would share it
+		if metric.IsNameTemplate() && !strings.Contains(metric.GetID(), "{{") && !metric.MultiSeries {
+			return fmt.Errorf(
+				"metric %s renders its name with series labels, so its id %s has to use them too (or be left empty)",
+				metric.Name,
+				metric.ID,
+			)
+		}
+		_, err = NewTemplate(metric.Name).Parse(metric.Topic)
+		if err != nil {
+			return fmt.Errorf("invalid topic of metric %s: %w", metric.Name, err)
+		}
+		topic, static, err := c.staticTopic(metric)
+		if err != nil {
+			return fmt.Errorf("invalid topic of metric %s: %w", metric.Name, err)
+		}
+		if other, exists := topics[topic]; static && exists {
+			return fmt.Errorf("metrics %s and %s would be published on the same topic %s", other, metric.Name, topic)
+		}
+		if static {
+			topics[topic] = metric.Name
+		}
+		source, exists := c.Source(metric.GetSource())
+		if !exists {
+			return fmt.Errorf("metric %s references unknown source %s", metric.Name, metric.GetSource())
+		}
+		if source.GetType() == SourceLocal {
+			err = source.validateLookback(metric)
+			if err != nil {
+				return fmt.Errorf("metric %s can not be queried from local source %s: %w", metric.Name, source.Name, err)
+			}
+		}
+		switch metric.GetReduce() {
+		case ReduceLast, ReduceMin, ReduceMax, ReduceAvg, ReduceSum, ReduceJSON:
+		default:
+			return fmt.Errorf("unknown reduce %q of metric %s", metric.Reduce, metric.Name)
+		}
+		if metric.Cron != "" {
+			_, err = cron.ParseStandard(metric.Cron)
+			if err != nil {
+				return fmt.Errorf("invalid cron of metric %s: %w", metric.Name, err)
+			}
+		}
+		if metric.GetInterval(c.Interval) <= 0 {
+			return fmt.Errorf("interval of metric %s must be positive", metric.Name)
+		}
+	}
+
+	return nil
+}
+
+func (c Config) validateDevices() error {
+	ids := make(map[string]struct{}, len(c.Mqtt.Devices))
+	for _, d := range c.Mqtt.Devices {
+		if d.ID == "" {
+			return fmt.Errorf("device %q has no id", d.Name)
+		}
+		if _, exists := ids[d.ID]; exists {
+			return fmt.Errorf("device %s is configured more than once", d.ID)
+		}
+		ids[d.ID] = struct{}{}
+
+		if d.ViaDevice == d.ID {
+			return fmt.Errorf("device %s can not be its own via_device", d.ID)
+		}
+		if _, exists := c.Mqtt.Device(d.ViaDevice); d.ViaDevice != "" && !exists {
+			return fmt.Errorf("device %s references unknown via_device %s", d.ID, d.ViaDevice)
+		}
+
+		for _, field := range []string{d.ID, d.Name, d.Model, d.Manufacturer, d.SuggestedArea, d.ViaDevice} {
+			_, err := NewTemplate(d.ID).Parse(field)
+			if err != nil {
+				return fmt.Errorf("invalid template in device %s: %w", d.ID, err)
+			}
+		}
+	}
 
-	return c, err
+	return nil
 }
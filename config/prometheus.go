@@ -0,0 +1,75 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Prometheus holds authentication and TLS options of the connection with Prometheus API
+type Prometheus struct {
+	BasicAuth BasicAuth `mapstructure:"basic_auth" envconfig:"basic_auth"`
+	// BearerToken is sent in Authorization header, BearerTokenFile is read on every request, so rotated tokens are used
+	BearerToken     string `mapstructure:"bearer_token" envconfig:"bearer_token"`
+	BearerTokenFile string `mapstructure:"bearer_token_file" envconfig:"bearer_token_file"`
+	// Headers are added to every request, e.g. X-Scope-OrgID of multi-tenant Mimir or Cortex
+	Headers map[string]string `mapstructure:"headers" envconfig:"headers"`
+	TLS     `mapstructure:",squash"`
+}
+
+// BasicAuth credentials, the files take precedence over the inline values
+type BasicAuth struct {
+	Username     string `mapstructure:"username" envconfig:"username"`
+	UsernameFile string `mapstructure:"username_file" envconfig:"username_file"`
+	Password     string `mapstructure:"password" envconfig:"password"`
+	PasswordFile string `mapstructure:"password_file" envconfig:"password_file"`
+}
+
+// IsSet will return true if any of the credentials is configured
+func (b BasicAuth) IsSet() bool {
+	return b.Username != "" || b.UsernameFile != "" || b.Password != "" || b.PasswordFile != ""
+}
+
+// Credentials will return the username and password, reading the files if configured
+func (b BasicAuth) Credentials() (string, string, error) {
+	username, err := secret(b.Username, b.UsernameFile)
+	if err != nil {
+		return "", "", err
+	}
+	password, err := secret(b.Password, b.PasswordFile)
+	if err != nil {
+		return "", "", err
+	}
+
+	return username, password, nil
+}
+
+// GetBearerToken will return the bearer token, reading the file if configured
+func (p Prometheus) GetBearerToken() (string, error) {
+	return secret(p.BearerToken, p.BearerTokenFile)
+}
+
+func (p Prometheus) validate() error {
+	if p.BearerToken != "" && p.BearerTokenFile != "" {
+		return fmt.Errorf("only one of bearer_token and bearer_token_file can be set")
+	}
+	if p.BasicAuth.IsSet() && (p.BearerToken != "" || p.BearerTokenFile != "") {
+		return fmt.Errorf("only one of basic_auth and bearer token can be set")
+	}
+
+	return nil
+}
+
+// secret will return content of the file without trailing whitespace, or the value if there is no file
+func secret(value, file string) (string, error) {
+	if file == "" {
+		return value, nil
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("could not read secret file: %w", err)
+	}
+
+	return strings.TrimSpace(string(content)), nil
+}
@@ -0,0 +1,186 @@
+package config
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// DefaultSource is the name of the source created from prometheus_url and prometheus options
+const DefaultSource = "default"
+
+const (
+	SourcePrometheus = "prometheus"
+	SourceLoki       = "loki"
+	SourceInfluxDB   = "influxdb"
+	SourceLocal      = "local"
+)
+
+const (
+	defaultScrapeInterval = 15 * time.Second
+	defaultRetention      = 10 * time.Minute
+)
+
+// Source is named data source, which metrics can be queried from. Its type selects the query language:
+// PromQL of Prometheus compatible API or local scrape targets, LogQL of Loki or Flux of InfluxDB v2
+type Source struct {
+	Name string `mapstructure:"name"`
+	// Type selects the implementation of the source: prometheus (default), loki, influxdb or local
+	Type string `mapstructure:"type"`
+	URL  string `mapstructure:"url"`
+	// Org is the organization of InfluxDB source
+	Org string `mapstructure:"org"`
+	// Targets are /metrics URLs of the exporters scraped by local source, which has no URL
+	Targets []string `mapstructure:"targets"`
+	// ScrapeInterval is how often local source scrapes its targets
+	ScrapeInterval time.Duration `mapstructure:"scrape_interval"`
+	// Retention is how long local source keeps the samples, it has to cover the ranges used in queries
+	Retention time.Duration `mapstructure:"retention"`
+	// Failover is ordered list of replica URLs queried when the previous ones fail, they share auth and TLS options
+	Failover []string `mapstructure:"failover"`
+	// Timeout overrides global ScrapeTimeout for metrics of this source
+	Timeout    time.Duration `mapstructure:"timeout"`
+	Prometheus `mapstructure:",squash"`
+}
+
+// GetType will return the implementation of the source, prometheus by default
+func (s Source) GetType() string {
+	if s.Type == "" {
+		return SourcePrometheus
+	}
+
+	return s.Type
+}
+
+// GetScrapeInterval will return how often local source scrapes its targets, 15s by default
+func (s Source) GetScrapeInterval() time.Duration {
+	if s.ScrapeInterval > 0 {
+		return s.ScrapeInterval
+	}
+
+	return defaultScrapeInterval
+}
+
+// GetRetention will return how long local source keeps the samples, 10m by default
+func (s Source) GetRetention() time.Duration {
+	if s.Retention > 0 {
+		return s.Retention
+	}
+
+	return defaultRetention
+}
+
+// URLs will return the primary URL followed by the failover ones
+func (s Source) URLs() []string {
+	return append([]string{s.URL}, s.Failover...)
+}
+
+// GetTimeout will return the timeout of queries, defaulting to given global timeout
+func (s Source) GetTimeout(defaultTimeout time.Duration) time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+
+	return defaultTimeout
+}
+
+// GetSources will return configured sources, including the default one when prometheus_url is set
+func (c Config) GetSources() []Source {
+	sources := make([]Source, 0, len(c.Sources)+1)
+	if c.PrometheusUrl != "" {
+		sources = append(sources, Source{Name: DefaultSource, URL: c.PrometheusUrl, Prometheus: c.Prometheus})
+	}
+
+	return append(sources, c.Sources...)
+}
+
+// Source will return the source with given name
+func (c Config) Source(name string) (Source, bool) {
+	for _, s := range c.GetSources() {
+		if s.Name == name {
+			return s, true
+		}
+	}
+
+	return Source{}, false
+}
+
+// MetricTimeout will return the timeout of the metric query, taking its source timeout into account
+func (c Config) MetricTimeout(m Metric) time.Duration {
+	source, _ := c.Source(m.GetSource())
+
+	return m.GetTimeout(source.GetTimeout(c.ScrapeTimeout))
+}
+
+// validateLookback will check the local source keeps the samples long enough for the range of the metric
+// and the range selectors and subqueries of its query, otherwise the query would silently use only a part of them
+func (s Source) validateLookback(m Metric) error {
+	expr, err := parser.ParseExpr(m.Query)
+	if err != nil {
+		return fmt.Errorf("invalid query: %w", err)
+	}
+
+	var lookback time.Duration
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		var selected time.Duration
+		switch n := node.(type) {
+		case *parser.MatrixSelector:
+			selected = n.Range
+			if vs, ok := n.VectorSelector.(*parser.VectorSelector); ok {
+				selected += vs.OriginalOffset
+			}
+		case *parser.VectorSelector:
+			selected = n.OriginalOffset
+		default:
+			return nil
+		}
+		for _, parent := range path {
+			if sq, ok := parent.(*parser.SubqueryExpr); ok {
+				selected += sq.Range + sq.OriginalOffset
+			}
+		}
+		if selected > lookback {
+			lookback = selected
+		}
+
+		return nil
+	})
+
+	if m.Range+lookback > s.GetRetention() {
+		return fmt.Errorf(
+			"query looks back %s, which is more than retention %s",
+			(m.Range + lookback).String(),
+			s.GetRetention().String(),
+		)
+	}
+
+	return nil
+}
+
+func (c Config) validateSources() error {
+	names := make(map[string]struct{}, len(c.Sources)+1)
+	for _, s := range c.GetSources() {
+		if s.Name == "" {
+			return fmt.Errorf("source %q has no name", s.URL)
+		}
+		if _, exists := names[s.Name]; exists {
+			return fmt.Errorf("source %s is configured more than once", s.Name)
+		}
+		names[s.Name] = struct{}{}
+
+		if s.GetType() == SourceLocal {
+			if len(s.Targets) == 0 {
+				return fmt.Errorf("local source %s has no targets", s.Name)
+			}
+		} else if s.URL == "" {
+			return fmt.Errorf("source %s has no url", s.Name)
+		}
+		err := s.validate()
+		if err != nil {
+			return fmt.Errorf("invalid source %s: %w", s.Name, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// TLS options of a connection. The files of MQTT connection are read again on every connection attempt,
+// so rotated certificates are used without restarting the bridge, while the data sources read them once on startup
+type TLS struct {
+	InsecureSkipVerify bool `mapstructure:"insecure_skip_verify" envconfig:"insecure_skip_verify" default:"false"`
+	// CAFile is PEM bundle of certificate authorities used to verify the server instead of the system ones
+	CAFile string `mapstructure:"ca_file" envconfig:"ca_file"`
+	// CertFile and KeyFile are PEM client certificate and its key presented to the server
+	CertFile   string `mapstructure:"cert_file" envconfig:"cert_file"`
+	KeyFile    string `mapstructure:"key_file" envconfig:"key_file"`
+	ServerName string `mapstructure:"server_name" envconfig:"server_name"`
+	// MinVersion is the minimum TLS version: "1.0", "1.1", "1.2" or "1.3"
+	MinVersion string `mapstructure:"min_version" envconfig:"min_version"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSConfig will read all the configured files and return the TLS configuration
+func (t TLS) TLSConfig() (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		InsecureSkipVerify: t.InsecureSkipVerify, //nolint:gosec
+		ServerName:         t.ServerName,
+	}
+
+	if t.MinVersion != "" {
+		version, exists := tlsVersions[t.MinVersion]
+		if !exists {
+			return nil, fmt.Errorf("unknown TLS min_version %q", t.MinVersion)
+		}
+		tlsCfg.MinVersion = version
+	}
+
+	if t.CAFile != "" {
+		ca, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", t.CAFile)
+		}
+	}
+
+	if t.CertFile != "" || t.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsCfg, nil
+}
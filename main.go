@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"flag"
+	"fmt"
 	"log"
 	"math/rand"
 	"net"
@@ -18,10 +19,8 @@ import (
 	"github.com/krzysztof-gzocha/prometheus2mqtt/config"
 	"github.com/krzysztof-gzocha/prometheus2mqtt/prometheus"
 	"github.com/krzysztof-gzocha/prometheus2mqtt/publisher"
+	"github.com/krzysztof-gzocha/prometheus2mqtt/source"
 	"github.com/krzysztof-gzocha/prometheus2mqtt/ticker"
-	"github.com/prometheus/client_golang/api"
-	promHttp "github.com/prometheus/client_golang/api/prometheus/v1"
-	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
 )
 
 func main() {
@@ -32,17 +31,40 @@ func main() {
 
 	var configFile string
 	flag.StringVar(&configFile, "config", "./config.yaml", "Full path of the config file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [cleanup]\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "  cleanup: remove HomeAssistant entities of metrics removed from the config and exit")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
+	cleanupOnly := flag.Arg(0) == "cleanup"
 
 	cfg, err := config.Load(configFile)
 	if err != nil {
 		logger.Fatalf("Could not load the configuration: %s", err.Error())
 	}
 
-	transport := defaultTransport(cfg.Interval)
-	prometheusAPI := getPrometheusClient(logger, cfg.PrometheusUrl, transport)
-	prometheusClient := prometheus.NewScraper(prometheusAPI, logger)
-	mqttClient := mqtt.NewClient(mqttClientOptions(cfg.Mqtt, logger))
+	queriers, err := source.NewQueriers(cfg, func() *http.Transport { return defaultTransport(cfg.Interval) }, logger)
+	if err != nil {
+		logger.Fatalf("Could not configure the sources: %s", err.Error())
+	}
+	prometheusClient := prometheus.NewScraper(queriers, cfg, logger)
+	var haPub *publisher.HomeAssistant
+	mqttClient := mqtt.NewClient(mqttClientOptions(cfg.Mqtt, logger, !cleanupOnly, func(c mqtt.Client) {
+		// publishers are created before connecting, so the handler is never called before haPub is set
+		if haPub != nil {
+			haPub.OnConnect(c)
+		}
+	}))
+
+	var mqttPub publisher.Publisher
+	mqttPub = publisher.NewSimple(cfg.Mqtt, mqttClient, logger)
+	if cfg.Mqtt.HAPublisher {
+		haPub = publisher.NewHomeAssistant(cfg.Mqtt, mqttClient, logger)
+		mqttPub = haPub
+	}
+	mqttPub = publisher.NewOnChange(mqttPub)
+
 	t := mqttClient.Connect()
 
 	select {
@@ -59,18 +81,45 @@ func main() {
 		logger.Fatalf("couldn't connect to mqtt")
 	}
 
-	var mqttPub publisher.Publisher
-	mqttPub = publisher.NewSimple(cfg.Mqtt, mqttClient, logger)
-	if cfg.Mqtt.HAPublisher {
-		mqttPub = publisher.NewHomeAssistant(cfg.Mqtt, mqttClient, logger)
+	if haPub != nil {
+		err = haPub.Cleanup(ctx, cfg.Metrics)
+		if err != nil {
+			logger.Printf("[ERROR] Could not remove stale HomeAssistant entities: %s\n", err.Error())
+		}
+	}
+	if cleanupOnly {
+		if haPub == nil {
+			logger.Printf("Nothing to clean up, ha_publisher is disabled")
+		}
+		mqttClient.Disconnect(50)
+		return
 	}
 
+	source.Run(ctx, queriers)
 	scrapingTicker := ticker.NewTicker(cfg, prometheusClient, mqttPub, logger)
 	scrapingTicker.Start(ctx)
+	disconnect(mqttClient, cfg.Mqtt, logger)
+}
+
+// disconnect will announce the bridge is offline and disconnect from MQTT broker.
+// Last will is not sent on graceful disconnect, so the bridge has to announce it on its own.
+func disconnect(mqttClient mqtt.Client, mqttConfig config.Mqtt, logger *log.Logger) {
+	t := mqttClient.Publish(mqttConfig.BridgeTopic(publisher.AvailabilityTopic), mqttConfig.Qos, true, publisher.PayloadOffline)
+	if !t.WaitTimeout(mqttConfig.PublishTimeout) || t.Error() != nil {
+		logger.Printf("[ERROR] Could not announce the bridge is offline: %v", t.Error())
+	}
 	mqttClient.Disconnect(50)
 }
 
-func mqttClientOptions(mqttConfig config.Mqtt, logger *log.Logger) *mqtt.ClientOptions {
+// mqttClientOptions will configure the client announcing the bridge availability.
+// Client which does not announce it (e.g. the one of cleanup command) gets its own client ID,
+// so it does not take over the connection of the running bridge.
+func mqttClientOptions(
+	mqttConfig config.Mqtt,
+	logger *log.Logger,
+	announce bool,
+	onConnect mqtt.OnConnectHandler,
+) *mqtt.ClientOptions {
 	mqtt.CRITICAL = logger
 	mqtt.ERROR = logger
 
@@ -79,19 +128,30 @@ func mqttClientOptions(mqttConfig config.Mqtt, logger *log.Logger) *mqtt.ClientO
 		randomId := rand.New(rand.NewSource(time.Now().UnixNano())).Intn(99999)
 		clientId = "p2m." + strconv.Itoa(randomId)
 	}
+	if !announce {
+		clientId += "-cleanup"
+	}
 
 	logger.Printf("ClientID: %s\n", clientId)
+	tlsCfg, err := mqttConfig.TLSConfig()
+	if err != nil {
+		logger.Fatalf("Could not load MQTT TLS configuration: %s", err.Error())
+	}
+	availabilityTopic := mqttConfig.BridgeTopic(publisher.AvailabilityTopic)
 	cfg := mqtt.NewClientOptions()
 	cfg.
 		SetClientID(clientId).
 		SetResumeSubs(true).
-		SetTLSConfig(&tls.Config{InsecureSkipVerify: mqttConfig.InsecureSkipVerify}).
+		SetTLSConfig(tlsCfg).
 		SetConnectRetry(true).
 		SetConnectRetryInterval(time.Second * 5).
 		SetConnectTimeout(time.Second * 2).
 		SetAutoReconnect(true).
 		SetUsername(mqttConfig.GetUser()).
 		SetPassword(mqttConfig.GetPassword())
+	if announce {
+		cfg.SetWill(availabilityTopic, publisher.PayloadOffline, mqttConfig.Qos, true)
+	}
 
 	servers, err := mqttConfig.ServersUrls()
 	if err != nil {
@@ -100,10 +160,21 @@ func mqttClientOptions(mqttConfig config.Mqtt, logger *log.Logger) *mqtt.ClientO
 	cfg.Servers = servers
 	cfg.OnConnectAttempt = func(url *url.URL, tlsCfg *tls.Config) *tls.Config {
 		logger.Printf("Attempting to connect with MQTT broker: %s\n", url.String())
-		return tlsCfg
+		// certificates are read again on every attempt, so the rotated ones are picked up on reconnect
+		reloaded, err := mqttConfig.TLSConfig()
+		if err != nil {
+			logger.Printf("[ERROR] Could not reload MQTT TLS configuration, using the previous one: %s\n", err.Error())
+			return tlsCfg
+		}
+
+		return reloaded
 	}
-	cfg.OnConnect = func(_ mqtt.Client) {
+	cfg.OnConnect = func(c mqtt.Client) {
 		logger.Println("Connected with MQTT broker")
+		if announce {
+			c.Publish(availabilityTopic, mqttConfig.Qos, true, publisher.PayloadOnline)
+		}
+		onConnect(c)
 	}
 	cfg.OnReconnecting = func(_ mqtt.Client, _ *mqtt.ClientOptions) {
 		logger.Println("Reconnecting with MQTT broker...")
@@ -129,15 +200,3 @@ func defaultTransport(interval time.Duration) *http.Transport {
 		ExpectContinueTimeout: 1 * time.Second,
 	}
 }
-
-func getPrometheusClient(logger *log.Logger, url string, trip http.RoundTripper) v1.API {
-	promClient, err := api.NewClient(api.Config{
-		Address:      url,
-		RoundTripper: trip,
-	})
-	if err != nil {
-		logger.Fatal(err.Error())
-	}
-
-	return promHttp.NewAPI(promClient)
-}
@@ -0,0 +1,85 @@
+package prometheus
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/krzysztof-gzocha/prometheus2mqtt/config"
+	"github.com/prometheus/common/model"
+)
+
+// reduce will turn all the points of a single series into one publishable value
+func reduce(reduction string, points []model.SamplePair) (string, error) {
+	switch reduction {
+	case config.ReduceLast:
+		return formatValue(points[len(points)-1].Value), nil
+	case config.ReduceMin:
+		min := points[0].Value
+		for _, p := range points[1:] {
+			if p.Value < min {
+				min = p.Value
+			}
+		}
+
+		return formatValue(min), nil
+	case config.ReduceMax:
+		max := points[0].Value
+		for _, p := range points[1:] {
+			if p.Value > max {
+				max = p.Value
+			}
+		}
+
+		return formatValue(max), nil
+	case config.ReduceSum, config.ReduceAvg:
+		var sum model.SampleValue
+		for _, p := range points {
+			sum += p.Value
+		}
+		if reduction == config.ReduceAvg {
+			sum /= model.SampleValue(len(points))
+		}
+
+		return formatValue(sum), nil
+	case config.ReduceJSON:
+		j, err := json.Marshal(points)
+		if err != nil {
+			return "", err
+		}
+
+		return string(j), nil
+	default:
+		return "", fmt.Errorf("unknown reduction %q", reduction)
+	}
+}
+
+type historyPayload struct {
+	Timestamps []int64       `json:"t"`
+	Values     []interface{} `json:"v"`
+}
+
+// history will encode all the points as compact JSON with unix timestamps and values in separate arrays.
+// Values which can not be represented in JSON (NaN, Inf) are encoded as null.
+func history(points []model.SamplePair) (string, error) {
+	h := historyPayload{
+		Timestamps: make([]int64, 0, len(points)),
+		Values:     make([]interface{}, 0, len(points)),
+	}
+	for _, p := range points {
+		h.Timestamps = append(h.Timestamps, p.Timestamp.Unix())
+		v := float64(p.Value)
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			h.Values = append(h.Values, nil)
+			continue
+		}
+		h.Values = append(h.Values, v)
+	}
+
+	j, err := json.Marshal(&h)
+	if err != nil {
+		return "", err
+	}
+
+	return string(j), nil
+}
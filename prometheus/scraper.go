@@ -1,54 +1,371 @@
 package prometheus
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/krzysztof-gzocha/prometheus2mqtt/config"
+	"github.com/krzysztof-gzocha/prometheus2mqtt/sample"
+	"github.com/krzysztof-gzocha/prometheus2mqtt/source"
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/common/model"
 )
 
 type Scraper struct {
-	prometheusClient v1.API
-	logger           *log.Logger
+	sources map[string][]source.Querier
+	cfg     config.Config
+	logger  *log.Logger
+	// slots limit the queries running at once across all Scrape calls, e.g. of groups scheduled at the same time
+	slots chan struct{}
 }
 
-func NewScraper(prometheus v1.API, logger *log.Logger) Scraper {
-	return Scraper{prometheusClient: prometheus, logger: logger}
+// NewScraper will create Scraper running at most cfg.Concurrency queries at once (in total, for all Scrape calls),
+// each limited by cfg.ScrapeTimeout, unless the metric or its source has its own timeout configured.
+// Sources map the source name to its clients, which are queried in order until one of them succeeds.
+func NewScraper(sources map[string][]source.Querier, cfg config.Config, logger *log.Logger) Scraper {
+	if cfg.Concurrency < 1 {
+		cfg.Concurrency = 1
+	}
+
+	return Scraper{
+		sources: sources,
+		cfg:     cfg,
+		logger:  logger,
+		slots:   make(chan struct{}, cfg.Concurrency),
+	}
 }
 
-func (s Scraper) Scrape(ctx context.Context, metrics ...config.Metric) (map[string]string, error) {
-	result := make(map[string]string)
+// Scrape will query every metric independently, so failure of one of them does not affect the others
+func (s Scraper) Scrape(ctx context.Context, metrics ...config.Metric) sample.Result {
+	result := sample.Result{
+		Samples:  make([]sample.Sample, 0, len(metrics)),
+		Errors:   make(map[string]error),
+		Warnings: make(map[string][]string),
+		Stats:    make(map[string]sample.Stats),
+	}
 
-	for _, metric := range metrics {
-		val, _, err := s.prometheusClient.Query(ctx, metric.Query, time.Time{})
-		if err != nil {
-			return result, err
+	samples := make([][]sample.Sample, len(metrics))
+	warnings := make([]v1.Warnings, len(metrics))
+	stats := make([]sample.Stats, len(metrics))
+	errs := make([]error, len(metrics))
+	indexes := make(chan int)
+	wg := sync.WaitGroup{}
+	for w := 0; w < s.cfg.Concurrency && w < len(metrics); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				select {
+				case s.slots <- struct{}{}:
+				case <-ctx.Done():
+					errs[i] = ctx.Err()
+					continue
+				}
+				start := time.Now()
+				samples[i], warnings[i], errs[i] = s.scrapeMetric(ctx, metrics[i])
+				stats[i] = sample.Stats{Duration: time.Since(start), Series: len(samples[i])}
+				<-s.slots
+			}
+		}()
+	}
+
+	for i := range metrics {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	for i, metric := range metrics {
+		result.Stats[metric.Name] = stats[i]
+		if len(warnings[i]) > 0 {
+			result.Warnings[metric.Name] = warnings[i]
+		}
+		if errs[i] != nil {
+			result.Errors[metric.Name] = errs[i]
+			continue
+		}
+		result.Samples = append(result.Samples, samples[i]...)
+	}
+
+	return result
+}
+
+func (s Scraper) scrapeMetric(ctx context.Context, metric config.Metric) ([]sample.Sample, v1.Warnings, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.MetricTimeout(metric))
+	defer cancel()
+
+	val, warnings, err := s.query(ctx, metric)
+	if len(warnings) > 0 {
+		s.logger.Printf("Query of metric %s returned warnings: %s\n", metric.Name, strings.Join(warnings, "; "))
+		if err == nil && s.cfg.WarningsAsErrors {
+			err = fmt.Errorf("query returned warnings: %s", strings.Join(warnings, "; "))
+		}
+	}
+	if err != nil {
+		return nil, warnings, err
+	}
+
+	samples, err := s.samples(metric, val)
+
+	return samples, warnings, err
+}
+
+// query will send the query to the metric source, falling back to its replicas when the query could not be executed.
+// Every attempt gets its share of the time left until the deadline of ctx, so the primary which does not respond
+// leaves time for the replicas.
+func (s Scraper) query(ctx context.Context, metric config.Metric) (model.Value, v1.Warnings, error) {
+	clients := s.sources[metric.GetSource()]
+	if len(clients) == 0 {
+		return nil, nil, fmt.Errorf("unknown source %s", metric.GetSource())
+	}
+
+	var err error
+	for i, client := range clients {
+		attemptCtx, cancel := attemptContext(ctx, len(clients)-i)
+		var val model.Value
+		var warnings v1.Warnings
+		val, warnings, err = s.queryClient(attemptCtx, client, metric)
+		failover := shouldFailover(ctx, attemptCtx, err)
+		cancel()
+		if !failover {
+			return val, warnings, err
 		}
+		if i < len(clients)-1 {
+			s.logger.Printf("[ERROR] Query of metric %s failed, trying replica %d of source %s: %s\n", metric.Name, i+1, metric.GetSource(), err.Error())
+		}
+	}
+
+	return nil, nil, err
+}
+
+// attemptContext will limit the attempt to its share of the time left for given number of remaining attempts
+func attemptContext(ctx context.Context, remaining int) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, time.Until(deadline)/time.Duration(remaining))
+}
+
+// shouldFailover will return true when the query failed for reasons other than the query itself or cancelled context.
+// The attempt which ran out of its share of the time is failed over, unless there is no time left at all.
+func shouldFailover(ctx, attemptCtx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	if attemptCtx.Err() != nil {
+		return true
+	}
+
+	var apiErr *v1.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.Type != v1.ErrBadData && apiErr.Type != v1.ErrCanceled
+	}
+
+	return true
+}
+
+// queryClient will run range query for metrics with configured range and instant query for the rest
+func (s Scraper) queryClient(ctx context.Context, client source.Querier, metric config.Metric) (model.Value, v1.Warnings, error) {
+	if metric.Range == 0 {
+		return client.Query(ctx, metric.Query, time.Time{})
+	}
+
+	end := time.Now()
+
+	return client.QueryRange(ctx, metric.Query, v1.Range{
+		Start: end.Add(-metric.Range),
+		End:   end,
+		Step:  metric.GetStep(),
+	})
+}
 
-		switch v := val.(type) {
-		// @todo add all possible types coming from Query()
-		case model.Vector:
-			if len(v) == 0 {
+// samples will convert the query result into samples, one for each returned series
+func (s Scraper) samples(metric config.Metric, val model.Value) ([]sample.Sample, error) {
+	switch v := val.(type) {
+	case model.Vector:
+		series := make([]seriesValue, 0, len(v))
+		for _, vs := range v {
+			series = append(series, seriesValue{
+				metric:    vs.Metric,
+				value:     formatValue(vs.Value),
+				timestamp: vs.Timestamp.Time(),
+			})
+		}
+
+		return s.seriesSamples(metric, series)
+	case model.Matrix:
+		series := make([]seriesValue, 0, len(v))
+		for _, ss := range v {
+			if len(ss.Values) == 0 {
 				continue
 			}
-			result[metric.Name] = strconv.FormatFloat(
-				float64(v[0].Value),
-				'f',
-				-1,
-				64,
-			)
-		default:
+			value, err := reduce(metric.GetReduce(), ss.Values)
+			if err != nil {
+				return nil, fmt.Errorf("could not reduce metric %s: %w", metric.Name, err)
+			}
+			sv := seriesValue{
+				metric:    ss.Metric,
+				value:     value,
+				timestamp: ss.Values[len(ss.Values)-1].Timestamp.Time(),
+			}
+			if metric.Range > 0 {
+				sv.history, err = history(ss.Values)
+				if err != nil {
+					return nil, fmt.Errorf("could not encode history of metric %s: %w", metric.Name, err)
+				}
+			}
+			series = append(series, sv)
+		}
+
+		return s.seriesSamples(metric, series)
+	case *model.Scalar:
+		return s.seriesSamples(metric, []seriesValue{{value: formatValue(v.Value), timestamp: v.Timestamp.Time()}})
+	case *model.String:
+		return s.seriesSamples(metric, []seriesValue{{value: v.Value, timestamp: v.Timestamp.Time()}})
+	default:
+		s.logger.Printf(
+			"Metric %s is unsupported type %T. Skipping it..",
+			metric.Name,
+			val,
+		)
+
+		return nil, nil
+	}
+}
+
+type seriesValue struct {
+	metric    model.Metric
+	value     string
+	timestamp time.Time
+	history   string
+}
+
+// seriesSamples will create one sample per series, each with a name rendered from its labels
+func (s Scraper) seriesSamples(metric config.Metric, series []seriesValue) ([]sample.Sample, error) {
+	nameTpl, err := config.NewTemplate(metric.Name).Option("missingkey=zero").Parse(metric.Name)
+	if err != nil {
+		return nil, err
+	}
+	idTpl, err := config.NewTemplate(metric.GetID()).Option("missingkey=zero").Parse(metric.GetID())
+	if err != nil {
+		return nil, err
+	}
+
+	samples := make([]sample.Sample, 0, len(series))
+	seen := make(map[string]struct{}, len(series))
+	for _, sv := range series {
+		labels := seriesLabels(sv.metric)
+		name, err := seriesName(metric.Name, nameTpl, labels, metric.MultiSeries)
+		if err != nil {
+			return nil, err
+		}
+		id, err := seriesName(metric.GetID(), idTpl, labels, metric.MultiSeries)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, exists := seen[name]; exists {
 			s.logger.Printf(
-				"Metric %s is type %T, not model.Vector. Skipping it..",
+				"Metric %s returned more than one series named %s. Skipping duplicate: %s",
 				metric.Name,
-				val,
+				name,
+				sv.metric.String(),
 			)
+			continue
 		}
+		seen[name] = struct{}{}
+
+		samples = append(samples, sample.Sample{
+			Metric:    metric,
+			ID:        id,
+			Name:      name,
+			Value:     sv.value,
+			Labels:    labels,
+			Timestamp: sv.timestamp,
+		})
+		if sv.history != "" {
+			samples = append(samples, sample.Sample{
+				Metric:    metric,
+				ID:        id,
+				Name:      name,
+				Sub:       sample.SubHistory,
+				Value:     sv.history,
+				Labels:    labels,
+				Timestamp: sv.timestamp,
+			})
+		}
+	}
+
+	return samples, nil
+}
+
+// seriesName renders the metric name with series labels.
+// Names without template actions get the label values appended when the metric has multi_series enabled,
+// so the name of the series does not depend on how many other series the query returned.
+func seriesName(
+	pattern string,
+	nameTpl *template.Template,
+	labels map[string]string,
+	multiSeries bool,
+) (string, error) {
+	if !strings.Contains(pattern, "{{") {
+		suffix := joinLabelValues(labels)
+		if !multiSeries || suffix == "" {
+			return pattern, nil
+		}
+
+		return pattern + "/" + suffix, nil
+	}
+
+	buf := bytes.Buffer{}
+	err := nameTpl.Execute(&buf, labels)
+
+	return buf.String(), err
+}
+
+func seriesLabels(m model.Metric) map[string]string {
+	labels := make(map[string]string, len(m))
+	for name, value := range m {
+		labels[string(name)] = string(value)
+	}
+
+	return labels
+}
+
+func joinLabelValues(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if name == model.MetricNameLabel {
+			continue
+		}
+		names = append(names, name)
 	}
+	sort.Strings(names)
+
+	values := make([]string, 0, len(names))
+	for _, name := range names {
+		// values like "/" or "/dev/sda1" would create empty topic levels, "+" and "#" wildcards
+		value := config.Slug(labels[name])
+		if value == "" {
+			value = "_"
+		}
+		values = append(values, value)
+	}
+
+	return strings.Join(values, "/")
+}
 
-	return result, nil
+func formatValue(v model.SampleValue) string {
+	return strconv.FormatFloat(float64(v), 'f', -1, 64)
 }
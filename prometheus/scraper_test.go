@@ -0,0 +1,140 @@
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/krzysztof-gzocha/prometheus2mqtt/config"
+	"github.com/krzysztof-gzocha/prometheus2mqtt/source"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+)
+
+// vectorResponse is single series vector result of Prometheus and Loki APIs
+const vectorResponse = `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1633860000,"1"]}]}}`
+
+func TestScraperFailover(t *testing.T) {
+	sourceTypes := []struct {
+		sourceType string
+		response   string
+	}{
+		{sourceType: config.SourcePrometheus, response: vectorResponse},
+		{sourceType: config.SourceLoki, response: vectorResponse},
+		{
+			sourceType: config.SourceInfluxDB,
+			response:   "#datatype,string,long,dateTime:RFC3339,double\r\n,result,table,_time,_value\r\n,,0,2021-10-10T10:00:00Z,1\r\n",
+		},
+	}
+	tests := []struct {
+		name     string
+		status   int
+		failover bool
+	}{
+		{name: "bad query", status: http.StatusBadRequest, failover: false},
+		{name: "server error", status: http.StatusServiceUnavailable, failover: true},
+	}
+
+	for _, st := range sourceTypes {
+		for _, test := range tests {
+			t.Run(st.sourceType+"/"+test.name, func(t *testing.T) {
+				primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(test.status)
+					_, _ = w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"parse error"}`))
+				}))
+				defer primary.Close()
+				var replicaQueries int32
+				replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+					atomic.AddInt32(&replicaQueries, 1)
+					_, _ = w.Write([]byte(st.response))
+				}))
+				defer replica.Close()
+
+				cfg := config.Config{
+					ScrapeTimeout: time.Second,
+					Sources: []config.Source{{
+						Name:     config.DefaultSource,
+						Type:     st.sourceType,
+						URL:      primary.URL,
+						Failover: []string{replica.URL},
+						Org:      "home",
+					}},
+				}
+				queriers, err := source.NewQueriers(cfg, func() *http.Transport {
+					return http.DefaultTransport.(*http.Transport).Clone()
+				}, log.New(io.Discard, "", 0))
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				scraper := NewScraper(queriers, cfg, log.New(io.Discard, "", 0))
+
+				samples, _, err := scraper.scrapeMetric(context.Background(), config.Metric{Name: "errors", Query: "errors"})
+				queried := atomic.LoadInt32(&replicaQueries) > 0
+				if queried != test.failover {
+					t.Errorf("expected replica queried: %t, got %t", test.failover, queried)
+				}
+				if test.failover {
+					if err != nil {
+						t.Fatalf("expected the replica to answer, got %v", err)
+					}
+					if len(samples) != 1 || samples[0].Value != "1" {
+						t.Errorf("unexpected samples %v", samples)
+					}
+					return
+				}
+				var apiErr *v1.Error
+				if !errors.As(err, &apiErr) || apiErr.Type != v1.ErrBadData {
+					t.Errorf("expected bad data error, got %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestScraperFailoverOnTimeout(t *testing.T) {
+	release := make(chan struct{})
+	primary := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		<-release
+	}))
+	defer primary.Close()
+	defer close(release)
+	replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(vectorResponse))
+	}))
+	defer replica.Close()
+
+	cfg := config.Config{
+		ScrapeTimeout: time.Second,
+		Sources: []config.Source{{
+			Name:     config.DefaultSource,
+			URL:      primary.URL,
+			Failover: []string{replica.URL},
+		}},
+	}
+	queriers, err := source.NewQueriers(cfg, func() *http.Transport {
+		return http.DefaultTransport.(*http.Transport).Clone()
+	}, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	scraper := NewScraper(queriers, cfg, log.New(io.Discard, "", 0))
+
+	start := time.Now()
+	samples, _, err := scraper.scrapeMetric(context.Background(), config.Metric{Name: "up", Query: "up"})
+	if err != nil {
+		t.Fatalf("expected the replica to answer, got %v", err)
+	}
+	if len(samples) != 1 || samples[0].Value != "1" {
+		t.Errorf("unexpected samples %v", samples)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the query to finish within scrape timeout, took %s", elapsed)
+	}
+}
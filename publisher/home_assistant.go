@@ -1,41 +1,84 @@
 package publisher
 
 import (
+	"bytes"
 	"context"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"hash/crc32"
 	"log"
-	"regexp"
 	"strings"
+	"sync"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/krzysztof-gzocha/prometheus2mqtt/config"
+	"github.com/krzysztof-gzocha/prometheus2mqtt/sample"
 )
 
 const deviceName = "prometheus2mqtt"
 const deviceManufacturer = "Krzysztof Gzocha Twitter:@kgzocha"
 
 type haConfigMessage struct {
-	Name       string   `json:"name"`
-	StateTopic string   `json:"state_topic"`
-	Device     haDevice `json:"device"`
+	Name                      string           `json:"name"`
+	UniqueID                  string           `json:"unique_id"`
+	ObjectID                  string           `json:"object_id"`
+	StateTopic                string           `json:"state_topic"`
+	JSONAttributesTopic       string           `json:"json_attributes_topic,omitempty"`
+	Availability              []haAvailability `json:"availability"`
+	AvailabilityMode          string           `json:"availability_mode"`
+	Device                    *haDevice        `json:"device,omitempty"`
+	Platform                  string           `json:"p,omitempty"`
+	UnitOfMeasurement         string           `json:"unit_of_measurement,omitempty"`
+	DeviceClass               string           `json:"device_class,omitempty"`
+	StateClass                string           `json:"state_class,omitempty"`
+	Icon                      string           `json:"icon,omitempty"`
+	ExpireAfter               int              `json:"expire_after,omitempty"`
+	ForceUpdate               bool             `json:"force_update,omitempty"`
+	SuggestedDisplayPrecision *int             `json:"suggested_display_precision,omitempty"`
+	EntityCategory            string           `json:"entity_category,omitempty"`
+	ValueTemplate             string           `json:"value_template,omitempty"`
+	PayloadOn                 string           `json:"payload_on,omitempty"`
+	PayloadOff                string           `json:"payload_off,omitempty"`
+	EventTypes                []string         `json:"event_types,omitempty"`
+	CommandTopic              string           `json:"command_topic,omitempty"`
+	Mode                      string           `json:"mode,omitempty"`
+}
+
+type haAvailability struct {
+	Topic string `json:"topic"`
 }
 
 type haDevice struct {
-	Manufacturer string `json:"manufacturer"`
-	Name         string `json:"name"`
-	Identifiers  string `json:"identifiers"`
-	Version      string `json:"sw_version"`
+	Manufacturer  string   `json:"manufacturer,omitempty"`
+	Name          string   `json:"name"`
+	Model         string   `json:"model,omitempty"`
+	Identifiers   []string `json:"identifiers"`
+	Version       string   `json:"sw_version"`
+	SuggestedArea string   `json:"suggested_area,omitempty"`
+	ViaDevice     string   `json:"via_device,omitempty"`
 }
 
 type HomeAssistant struct {
-	nonAlfaChars      *regexp.Regexp
-	cfg               config.Mqtt
-	mqtt              mqtt.Client
-	logger            *log.Logger
-	alreadyConfigured map[string]interface{}
+	cfg    config.Mqtt
+	mqtt   mqtt.Client
+	logger *log.Logger
+	mu     sync.Mutex
+	// alreadyConfigured holds the metric name of every configured object ID
+	alreadyConfigured map[string]string
+	// latest holds the last published sample of every state topic, so it can be published again when HomeAssistant restarts
+	latest map[string]sample.Sample
+	// availability holds the last availability of every metric by its topic, it is published only when it changes,
+	// so it has to be published again when HomeAssistant restarts
+	availability map[string]sample.Sample
+	// manifest holds all the topics published for every object ID, so they can be removed once the metric is removed
+	manifest map[string]manifestEntry
+	// manifestLoaded is true once the retained manifest was loaded or is known to be absent
+	manifestLoaded bool
+	// manifestChanged is true when the manifest has topics, which were not published yet
+	manifestChanged bool
+	// devices holds the device discovery message of every device, when HADeviceDiscovery is enabled
+	devices map[string]*haDeviceConfig
+	// pending holds the samples of components added to the device since its discovery was published, by object ID
+	pending map[string]map[string]sample.Sample
 }
 
 func NewHomeAssistant(
@@ -44,46 +87,245 @@ func NewHomeAssistant(
 	logger *log.Logger,
 ) *HomeAssistant {
 	return &HomeAssistant{
-		nonAlfaChars:      regexp.MustCompile("[^a-zA-Z0-9]"),
 		cfg:               cfg,
 		mqtt:              mqtt,
 		logger:            logger,
-		alreadyConfigured: make(map[string]interface{}),
+		alreadyConfigured: make(map[string]string),
+		latest:            make(map[string]sample.Sample),
+		availability:      make(map[string]sample.Sample),
+		manifest:          make(map[string]manifestEntry),
+		devices:           make(map[string]*haDeviceConfig),
+		pending:           make(map[string]map[string]sample.Sample),
 	}
 }
 
-func (h *HomeAssistant) Publish(ctx context.Context, name, value string) error {
-	if !h.isConfigured(name) {
-		err := h.configure(ctx, name)
+func (h *HomeAssistant) Publish(ctx context.Context, s sample.Sample) error {
+	return h.publish(ctx, s, true)
+}
+
+// publish will configure the entity of the sample and publish its state, unless sendState is false
+func (h *HomeAssistant) publish(ctx context.Context, s sample.Sample, sendState bool) error {
+	value := s.Value
+	topic, err := h.sampleTopic(s)
+	if err != nil {
+		return err
+	}
+	if s.Sub == sample.SubAvailability {
+		h.mu.Lock()
+		h.availability[topic] = s
+		h.mu.Unlock()
+	}
+	if s.Sub != "" {
+		// auxiliary values are not sensors on their own, so they are sent next to the state topic without discovery
+		h.logger.Printf("Sending \t%s\t to \t%s\n", value, topic)
+
+		return h.sendOwned(ctx, s, topic, value, h.cfg.RetainMessages)
+	}
+
+	value, err = state(s)
+	if err != nil {
+		return fmt.Errorf("could not map value of metric %s: %w", s.Name, err)
+	}
+	h.mu.Lock()
+	h.latest[topic] = s
+	h.mu.Unlock()
+
+	configured, err := h.isConfigured(s)
+	if err != nil {
+		return err
+	}
+	if !configured {
+		err := h.configure(ctx, s)
 		if err != nil {
-			return fmt.Errorf("could not send configuration message for metric %s: %s", name, err.Error())
+			return fmt.Errorf("could not send configuration message for metric %s: %s", s.Name, err.Error())
 		}
 	}
 
-	h.logger.Printf("Sending \t%s\t to \t%s\n", value, h.stateTopic(name))
+	if h.cfg.HAJSONAttributes {
+		err = h.publishAttributes(ctx, s)
+		if err != nil {
+			return fmt.Errorf("could not publish attributes of metric %s: %w", s.Name, err)
+		}
+	}
+
+	if !sendState {
+		return nil
+	}
+	h.logger.Printf("Sending \t%s\t to \t%s\n", value, topic)
+
+	return h.sendOwned(ctx, s, topic, value, h.retainState(s))
+}
+
+// publishAttributes will publish the labels, timestamp and query of the sample on its JSON attributes topic
+func (h *HomeAssistant) publishAttributes(ctx context.Context, s sample.Sample) error {
+	attributes := s
+	attributes.Sub = sample.SubAttributes
+	topic, err := h.sampleTopic(attributes)
+	if err != nil {
+		return err
+	}
+
+	j, err := json.Marshal(s.Attributes())
+	if err != nil {
+		return err
+	}
+
+	return h.sendOwned(ctx, s, topic, string(j), h.cfg.RetainMessages)
+}
+
+func (h *HomeAssistant) PublishBridge(ctx context.Context, name, value string) error {
+	h.logger.Printf("Sending \t%s\t to \t%s\n", value, h.cfg.BridgeTopic(name))
+
+	return h.send(ctx, h.cfg.BridgeTopic(name), value, true)
+}
+
+// OnConnect will subscribe to HomeAssistant status topic, so the discovery is sent again when HomeAssistant restarts
+func (h *HomeAssistant) OnConnect(c mqtt.Client) {
+	topic := h.cfg.DiscoveryPrefix + "/status"
+	c.Subscribe(topic, h.cfg.Qos, func(_ mqtt.Client, msg mqtt.Message) {
+		if string(msg.Payload()) != PayloadOnline {
+			return
+		}
+
+		// publishing from within the message handler would block the client
+		go h.reannounce(context.Background())
+	})
+	h.logger.Printf("Subscribed to HomeAssistant status on %s\n", topic)
+}
+
+// reannounce will forget all configured entities and publish the latest samples again, including the discovery
+func (h *HomeAssistant) reannounce(ctx context.Context) {
+	h.mu.Lock()
+	h.alreadyConfigured = make(map[string]string)
+	latest := make([]sample.Sample, 0, len(h.latest))
+	for _, s := range h.latest {
+		latest = append(latest, s)
+	}
+	availability := make([]sample.Sample, 0, len(h.availability))
+	for _, s := range h.availability {
+		availability = append(availability, s)
+	}
+	h.mu.Unlock()
+
+	h.logger.Printf("HomeAssistant is online, announcing %d topic(s) again\n", len(latest))
+	for _, s := range latest {
+		// events are announced without publishing the last one again, so it is not triggered twice
+		err := h.publish(ctx, s, !isEvent(s))
+		if err != nil {
+			h.logger.Printf("[ERROR] Could not announce metric %s again: %s\n", s.Name, err.Error())
+		}
+	}
+
+	err := h.Flush(ctx, sample.Result{})
+	if err != nil {
+		h.logger.Printf("[ERROR] Could not announce devices again: %s\n", err.Error())
+	}
+
+	// availability is sent after the discovery, otherwise HomeAssistant would not know the entities yet
+	for _, s := range availability {
+		err = h.publish(ctx, s, true)
+		if err != nil {
+			h.logger.Printf("[ERROR] Could not announce availability of metric %s again: %s\n", s.Metric.Name, err.Error())
+		}
+	}
+}
+
+// forget will stop announcing the series of successfully scraped metrics, which were not returned by the query
+func (h *HomeAssistant) forget(result sample.Result) {
+	live := make(map[string]struct{}, len(result.Samples))
+	for _, s := range result.Samples {
+		topic, err := h.sampleTopic(s)
+		if err == nil {
+			live[topic] = struct{}{}
+		}
+	}
 
-	return h.sendMsg(ctx, h.stateTopic(name), value)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for topic, s := range h.latest {
+		_, scraped := result.Stats[s.Metric.Name]
+		_, failed := result.Errors[s.Metric.Name]
+		if _, exists := live[topic]; scraped && !failed && !exists {
+			delete(h.latest, topic)
+		}
+	}
 }
 
-func (h *HomeAssistant) isConfigured(name string) bool {
-	_, exists := h.alreadyConfigured[name]
+// isConfigured will check if the entity of the sample was configured already.
+// Error is returned when the object ID of the sample is already used by a sample with different name.
+func (h *HomeAssistant) isConfigured(s sample.Sample) (bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	objectID := h.cfg.ObjectID(s.ID)
+	name, exists := h.alreadyConfigured[objectID]
+	if exists && name != s.Name {
+		return false, fmt.Errorf("metric %s collides with metric %s on object ID %s", s.Name, name, objectID)
+	}
 
-	return exists
+	return exists, nil
 }
 
-func (h *HomeAssistant) configure(ctx context.Context, name string) error {
-	sensorName := h.sensorName(name)
-	h.logger.Printf("Configuring sensor: %s (ID: %s)\n", sensorName, shortHash(sensorName))
+func (h *HomeAssistant) configure(ctx context.Context, s sample.Sample) error {
+	ha := s.Metric.HomeAssistant
+	sensorName := h.sensorName(s.Name)
+	objectID := h.cfg.ObjectID(s.ID)
+	h.logger.Printf("Configuring %s: %s (ID: %s)\n", ha.GetComponent(), sensorName, objectID)
+
+	device, err := h.device(s)
+	if err != nil {
+		return fmt.Errorf("could not render device: %w", err)
+	}
+	stateTopic, err := h.sampleTopic(s)
+	if err != nil {
+		return err
+	}
 
 	haCfg := haConfigMessage{
 		Name:       sensorName,
-		StateTopic: h.stateTopic(name),
-		Device: haDevice{
-			Manufacturer: deviceManufacturer,
-			Name:         deviceName,
-			Version:      config.Version,
-			Identifiers:  shortHash(sensorName),
+		UniqueID:   objectID,
+		ObjectID:   objectID,
+		StateTopic: stateTopic,
+		Availability: []haAvailability{
+			{Topic: h.cfg.BridgeTopic(AvailabilityTopic)},
 		},
+		AvailabilityMode:          "all",
+		Device:                    &device,
+		UnitOfMeasurement:         ha.UnitOfMeasurement,
+		DeviceClass:               ha.DeviceClass,
+		StateClass:                ha.StateClass,
+		Icon:                      ha.Icon,
+		ExpireAfter:               int(ha.ExpireAfter.Seconds()),
+		ForceUpdate:               ha.ForceUpdate,
+		SuggestedDisplayPrecision: ha.SuggestedDisplayPrecision,
+		EntityCategory:            ha.EntityCategory,
+		ValueTemplate:             ha.ValueTemplate,
+	}
+
+	if s.Metric.Availability {
+		availabilityTopic, err := h.sampleTopic(sample.Sample{
+			Metric: s.Metric,
+			ID:     s.Metric.BaseID(),
+			Name:   s.Metric.BaseName(),
+			Sub:    sample.SubAvailability,
+		})
+		if err != nil {
+			return err
+		}
+		haCfg.Availability = append(haCfg.Availability, haAvailability{Topic: availabilityTopic})
+	}
+	if h.cfg.HAJSONAttributes {
+		attributes := s
+		attributes.Sub = sample.SubAttributes
+		haCfg.JSONAttributesTopic, err = h.sampleTopic(attributes)
+		if err != nil {
+			return err
+		}
+	}
+	h.configureComponent(&haCfg, s)
+
+	if h.cfg.HADeviceDiscovery {
+		h.addToDevice(s, haCfg, device)
+		return nil
 	}
 
 	j, err := json.Marshal(&haCfg)
@@ -93,49 +335,107 @@ func (h *HomeAssistant) configure(ctx context.Context, name string) error {
 
 	h.logger.Printf(
 		"Configuring device on topic %s with payload %s\n",
-		h.configTopic(name),
+		h.configTopic(s),
 		string(j),
 	)
 
-	err = h.sendMsg(ctx, h.configTopic(name), string(j))
+	err = h.sendOwned(ctx, s, h.configTopic(s), string(j), h.cfg.RetainMessages)
 	if err != nil {
 		return err
 	}
 
-	h.alreadyConfigured[name] = struct{}{}
+	h.mu.Lock()
+	h.alreadyConfigured[objectID] = s.Name
+	h.mu.Unlock()
 
 	return nil
 }
 
+// device will return the device configured for the metric, rendered with series labels.
+// Metrics without configured device belong to the device of the bridge itself.
+func (h *HomeAssistant) device(s sample.Sample) (haDevice, error) {
+	d, exists := h.cfg.Device(s.Metric.HomeAssistant.Device)
+	if !exists {
+		return haDevice{
+			Manufacturer: deviceManufacturer,
+			Name:         deviceName,
+			Version:      config.Version,
+			Identifiers:  []string{config.Slug(h.cfg.ClientID)},
+		}, nil
+	}
+
+	fields := []*string{&d.ID, &d.Name, &d.Model, &d.Manufacturer, &d.SuggestedArea, &d.ViaDevice}
+	for _, field := range fields {
+		rendered, err := render(*field, s.Labels)
+		if err != nil {
+			return haDevice{}, err
+		}
+		*field = rendered
+	}
+
+	device := haDevice{
+		Manufacturer:  d.Manufacturer,
+		Name:          d.Name,
+		Model:         d.Model,
+		Identifiers:   []string{h.cfg.ObjectID(d.ID)},
+		Version:       config.Version,
+		SuggestedArea: d.SuggestedArea,
+	}
+	if device.Name == "" {
+		device.Name = d.ID
+	}
+	if d.ViaDevice != "" {
+		device.ViaDevice = h.cfg.ObjectID(d.ViaDevice)
+	}
+
+	return device, nil
+}
+
 func (h *HomeAssistant) sensorName(name string) string {
 	return h.cfg.ClientID + ": " + name
 }
 
-func (h *HomeAssistant) stateTopic(name string) string {
-	return fmt.Sprintf(
-		"%s/sensor/%s/state",
-		h.cfg.DiscoveryPrefix,
-		h.stripNonAlfa(h.sensorName(name)),
-	)
+// sampleTopic will return the topic of the sample, rendered from the topic template when configured
+func (h *HomeAssistant) sampleTopic(s sample.Sample) (string, error) {
+	topic, templated, err := renderTopic(h.cfg, s)
+	if templated || err != nil {
+		return topic, err
+	}
+	if s.Sub == "" {
+		return h.subTopic(s.Metric, s.ID, "state"), nil
+	}
+
+	return h.subTopic(s.Metric, s.ID, s.Sub), nil
+}
+
+func (h *HomeAssistant) configTopic(s sample.Sample) string {
+	return h.subTopic(s.Metric, s.ID, "config")
 }
 
-func (h *HomeAssistant) configTopic(name string) string {
+func (h *HomeAssistant) subTopic(metric config.Metric, id, sub string) string {
 	return fmt.Sprintf(
-		"%s/sensor/%s/config",
+		"%s/%s/%s/%s",
 		h.cfg.DiscoveryPrefix,
-		h.stripNonAlfa(h.sensorName(name)),
+		metric.HomeAssistant.GetComponent(),
+		h.cfg.ObjectID(id),
+		sub,
 	)
 }
 
-func (h *HomeAssistant) stripNonAlfa(name string) string {
-	return strings.Trim(h.nonAlfaChars.ReplaceAllString(name, "_"), "_")
+func (h *HomeAssistant) sendMsg(ctx context.Context, topic, msg string) error {
+	return h.send(ctx, topic, msg, h.cfg.RetainMessages)
 }
 
-func (h *HomeAssistant) sendMsg(ctx context.Context, topic, msg string) error {
+func (h *HomeAssistant) send(ctx context.Context, topic, msg string, retained bool) error {
+	err := config.ValidateTopic(topic)
+	if err != nil {
+		return err
+	}
+
 	token := h.mqtt.Publish(
 		topic,
 		h.cfg.Qos,
-		h.cfg.RetainMessages,
+		retained,
 		msg,
 	)
 
@@ -150,9 +450,19 @@ func (h *HomeAssistant) sendMsg(ctx context.Context, topic, msg string) error {
 	}
 }
 
-func shortHash(input string) string {
-	h := crc32.NewIEEE() //nolint:gosec
-	_, _ = h.Write([]byte(input))
+// render will execute the Go template with series labels
+func render(tpl string, labels map[string]string) (string, error) {
+	if !strings.Contains(tpl, "{{") {
+		return tpl, nil
+	}
+
+	t, err := config.NewTemplate(tpl).Option("missingkey=zero").Parse(tpl)
+	if err != nil {
+		return "", err
+	}
+
+	buf := bytes.Buffer{}
+	err = t.Execute(&buf, labels)
 
-	return hex.EncodeToString(h.Sum(nil))
+	return buf.String(), err
 }
@@ -0,0 +1,256 @@
+package publisher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/krzysztof-gzocha/prometheus2mqtt/config"
+	"github.com/krzysztof-gzocha/prometheus2mqtt/sample"
+)
+
+// ManifestTopic is the name of the bridge topic holding all the topics owned by HomeAssistant publisher
+const ManifestTopic = "discovery_manifest"
+
+// manifestWait is how long to wait for retained message (e.g. the manifest) after subscribing to it
+const manifestWait = 2 * time.Second
+
+type manifestEntry struct {
+	// Metric is the ID of configured metric, which produced the entity
+	Metric string   `json:"metric"`
+	Topics []string `json:"topics"`
+}
+
+// Cleanup will load the retained manifest and remove all the entities of metrics, which are not configured anymore,
+// by publishing empty retained messages on their topics.
+// The manifest is not published by Flush until it is loaded here, so it is not overwritten by incomplete one.
+func (h *HomeAssistant) Cleanup(ctx context.Context, metrics []config.Metric) error {
+	err := h.loadManifest(ctx)
+	if err != nil {
+		return fmt.Errorf("could not load discovery manifest: %w", err)
+	}
+
+	configured := make(map[string]struct{}, len(metrics))
+	for _, metric := range metrics {
+		configured[metric.GetID()] = struct{}{}
+	}
+
+	h.mu.Lock()
+	stale := make(map[string]manifestEntry)
+	for objectID, entry := range h.manifest {
+		if _, exists := configured[entry.Metric]; !exists {
+			stale[objectID] = entry
+		}
+	}
+	h.mu.Unlock()
+
+	if len(stale) == 0 {
+		h.logger.Println("No stale HomeAssistant entities found")
+		return nil
+	}
+
+	// device discovery topics are shared by all the components of the device, so only the stale ones are removed
+	deviceComponents := make(map[string][]string)
+	for objectID, entry := range stale {
+		h.logger.Printf("Removing HomeAssistant entity %s of removed metric %s\n", objectID, entry.Metric)
+		for _, topic := range entry.Topics {
+			if h.isDeviceTopic(topic) {
+				deviceComponents[topic] = append(deviceComponents[topic], objectID)
+				continue
+			}
+			err = h.send(ctx, topic, "", true)
+			if err != nil {
+				return fmt.Errorf("could not remove topic %s: %w", topic, err)
+			}
+		}
+	}
+
+	for topic, objectIDs := range deviceComponents {
+		err = h.removeComponents(ctx, topic, objectIDs)
+		if err != nil {
+			return fmt.Errorf("could not remove components from device %s: %w", topic, err)
+		}
+	}
+
+	h.mu.Lock()
+	for objectID := range stale {
+		delete(h.manifest, objectID)
+	}
+	h.manifestChanged = true
+	h.mu.Unlock()
+
+	return h.publishManifest(ctx)
+}
+
+// removeComponents will publish retained discovery of the device again with given components reduced to their platform,
+// which removes them from HomeAssistant. The discovery is removed completely when no other components remain.
+func (h *HomeAssistant) removeComponents(ctx context.Context, topic string, objectIDs []string) error {
+	payload, err := h.loadRetained(ctx, topic)
+	if err != nil {
+		return err
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+
+	dc := make(map[string]json.RawMessage)
+	err = json.Unmarshal(payload, &dc)
+	if err != nil {
+		return err
+	}
+	components := make(map[string]map[string]interface{})
+	if len(dc["cmps"]) > 0 {
+		err = json.Unmarshal(dc["cmps"], &components)
+		if err != nil {
+			return err
+		}
+	}
+	for _, objectID := range objectIDs {
+		if c, exists := components[objectID]; exists {
+			components[objectID] = map[string]interface{}{"p": c["p"]}
+		}
+	}
+
+	remaining := 0
+	for _, c := range components {
+		if len(c) > 1 {
+			remaining++
+		}
+	}
+	if remaining == 0 {
+		h.logger.Printf("Removing HomeAssistant device %s without components\n", topic)
+		return h.send(ctx, topic, "", true)
+	}
+
+	dc["cmps"], err = json.Marshal(components)
+	if err != nil {
+		return err
+	}
+	j, err := json.Marshal(dc)
+	if err != nil {
+		return err
+	}
+
+	return h.send(ctx, topic, string(j), true)
+}
+
+func (h *HomeAssistant) isDeviceTopic(topic string) bool {
+	return strings.HasPrefix(topic, h.cfg.DiscoveryPrefix+"/device/")
+}
+
+func (h *HomeAssistant) loadManifest(ctx context.Context) error {
+	payload, err := h.loadRetained(ctx, h.cfg.BridgeTopic(ManifestTopic))
+	if err != nil {
+		return err
+	}
+	if len(payload) == 0 {
+		h.setManifestLoaded()
+		return nil
+	}
+
+	manifest := make(map[string]manifestEntry)
+	err = json.Unmarshal(payload, &manifest)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	for objectID, entry := range manifest {
+		h.manifest[objectID] = entry
+	}
+	h.manifestLoaded = true
+	h.mu.Unlock()
+
+	return nil
+}
+
+// loadRetained will return the retained message of the topic, or empty payload when there is none
+func (h *HomeAssistant) loadRetained(ctx context.Context, topic string) ([]byte, error) {
+	received := make(chan []byte, 1)
+	token := h.mqtt.Subscribe(topic, h.cfg.Qos, func(_ mqtt.Client, msg mqtt.Message) {
+		select {
+		case received <- msg.Payload():
+		default:
+		}
+	})
+	if !token.WaitTimeout(h.cfg.PublishTimeout) {
+		return nil, fmt.Errorf("subscribing to %s exceeded timeout", topic)
+	}
+	if token.Error() != nil {
+		return nil, token.Error()
+	}
+	defer h.mqtt.Unsubscribe(topic)
+
+	select {
+	case payload := <-received:
+		return payload, nil
+	case <-time.After(manifestWait):
+		h.logger.Printf("No retained message found on %s\n", topic)
+		return nil, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (h *HomeAssistant) setManifestLoaded() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.manifestLoaded = true
+}
+
+// publishManifest will publish the manifest when it changed since it was published last time.
+// It is never published before the retained one is loaded (or known to be absent), so the stale entries are not lost.
+func (h *HomeAssistant) publishManifest(ctx context.Context) error {
+	h.mu.Lock()
+	if !h.manifestLoaded || !h.manifestChanged {
+		h.mu.Unlock()
+		return nil
+	}
+	j, err := json.Marshal(h.manifest)
+	h.manifestChanged = false
+	h.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = h.send(ctx, h.cfg.BridgeTopic(ManifestTopic), string(j), true)
+	if err != nil {
+		h.mu.Lock()
+		h.manifestChanged = true
+		h.mu.Unlock()
+	}
+
+	return err
+}
+
+// sendOwned will send the message and record the topic in the manifest
+func (h *HomeAssistant) sendOwned(ctx context.Context, s sample.Sample, topic, msg string, retained bool) error {
+	err := h.send(ctx, topic, msg, retained)
+	if err != nil {
+		return err
+	}
+	h.own(s, topic)
+
+	return nil
+}
+
+// own will record the topic in the manifest under the object ID of the sample,
+// the manifest is published once per Flush
+func (h *HomeAssistant) own(s sample.Sample, topic string) {
+	objectID := h.cfg.ObjectID(s.ID)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entry := h.manifest[objectID]
+	for _, owned := range entry.Topics {
+		if owned == topic {
+			return
+		}
+	}
+	entry.Metric = s.Metric.GetID()
+	entry.Topics = append(entry.Topics, topic)
+	h.manifest[objectID] = entry
+	h.manifestChanged = true
+}
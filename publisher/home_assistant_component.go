@@ -0,0 +1,78 @@
+package publisher
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/krzysztof-gzocha/prometheus2mqtt/config"
+	"github.com/krzysztof-gzocha/prometheus2mqtt/sample"
+)
+
+// configureComponent will set the fields of discovery message specific to the component of the metric
+func (h *HomeAssistant) configureComponent(haCfg *haConfigMessage, s sample.Sample) {
+	ha := s.Metric.HomeAssistant
+	switch ha.GetComponent() {
+	case config.ComponentBinarySensor:
+		haCfg.PayloadOn = ha.GetPayloadOn()
+		haCfg.PayloadOff = ha.GetPayloadOff()
+	case config.ComponentEvent:
+		haCfg.EventTypes = ha.EventTypes
+		if len(haCfg.EventTypes) == 0 {
+			haCfg.EventTypes = []string{ha.GetPayloadOn(), ha.GetPayloadOff()}
+		}
+	case config.ComponentText:
+		// text entity requires command topic, but it is read-only: nothing subscribes to it
+		// and the value is always overwritten by the next scrape
+		haCfg.CommandTopic = h.subTopic(s.Metric, s.ID, "set")
+		haCfg.Mode = "text"
+	}
+}
+
+// isEvent will return true for the state of event component
+func isEvent(s sample.Sample) bool {
+	return s.Sub == "" && s.Metric.HomeAssistant.GetComponent() == config.ComponentEvent
+}
+
+// retainState will return whether the state of the sample should be retained.
+// Events are never retained, otherwise HomeAssistant would trigger the last one again after every restart.
+func (h *HomeAssistant) retainState(s sample.Sample) bool {
+	return h.cfg.RetainMessages && !isEvent(s)
+}
+
+// state will map the value of the sample to the state expected by its HomeAssistant component
+func state(s sample.Sample) (string, error) {
+	ha := s.Metric.HomeAssistant
+	switch ha.GetComponent() {
+	case config.ComponentBinarySensor:
+		return onOff(ha, s.Value), nil
+	case config.ComponentEvent:
+		eventType := s.Value
+		if len(ha.EventTypes) == 0 {
+			eventType = onOff(ha, s.Value)
+		}
+		j, err := json.Marshal(map[string]string{"event_type": eventType})
+
+		return string(j), err
+	default:
+		return s.Value, nil
+	}
+}
+
+// onOff will map numeric value to payload_on when it is above the threshold (or non-zero without threshold)
+// and to payload_off otherwise. Non-numeric values are not mapped.
+func onOff(ha config.HomeAssistant, value string) string {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return value
+	}
+
+	on := v != 0
+	if ha.Threshold != nil {
+		on = v > *ha.Threshold
+	}
+	if on {
+		return ha.GetPayloadOn()
+	}
+
+	return ha.GetPayloadOff()
+}
@@ -0,0 +1,140 @@
+package publisher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/krzysztof-gzocha/prometheus2mqtt/config"
+	"github.com/krzysztof-gzocha/prometheus2mqtt/sample"
+)
+
+// haDeviceConfig is the discovery message of the whole device with all its components
+type haDeviceConfig struct {
+	Device     haDevice                   `json:"dev"`
+	Origin     haOrigin                   `json:"o"`
+	Components map[string]haConfigMessage `json:"cmps"`
+}
+
+type haOrigin struct {
+	Name    string `json:"name"`
+	Version string `json:"sw,omitempty"`
+}
+
+// addToDevice will add the component to the discovery message of its device.
+// The message is published by Flush, so a device with many components is announced with a single message.
+func (h *HomeAssistant) addToDevice(s sample.Sample, haCfg haConfigMessage, device haDevice) {
+	deviceID := device.Identifiers[0]
+	haCfg.Device = nil
+	haCfg.Platform = s.Metric.HomeAssistant.GetComponent()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	dc, exists := h.devices[deviceID]
+	if !exists {
+		dc = &haDeviceConfig{
+			Origin:     haOrigin{Name: deviceName, Version: config.Version},
+			Components: make(map[string]haConfigMessage),
+		}
+		h.devices[deviceID] = dc
+	}
+	dc.Device = device
+	dc.Components[haCfg.ObjectID] = haCfg
+	h.queue(deviceID, map[string]sample.Sample{haCfg.ObjectID: s}, true)
+}
+
+// queue will add the components to be published with the next discovery message of the device,
+// replacing already queued samples of the same components only when replace is true. It has to be called with mu locked.
+func (h *HomeAssistant) queue(deviceID string, samples map[string]sample.Sample, replace bool) {
+	if h.pending[deviceID] == nil {
+		h.pending[deviceID] = make(map[string]sample.Sample)
+	}
+	for objectID, s := range samples {
+		if _, exists := h.pending[deviceID][objectID]; exists && !replace {
+			continue
+		}
+		h.pending[deviceID][objectID] = s
+	}
+}
+
+// Flush will publish the discovery message of every device with new components
+// and publish the state of these components again, so it is not missed by HomeAssistant.
+// The components are configured only once the message is sent, otherwise they are queued for the next flush.
+// Series not returned by the scrape anymore are not announced again.
+func (h *HomeAssistant) Flush(ctx context.Context, result sample.Result) error {
+	h.forget(result)
+
+	h.mu.Lock()
+	pending := h.pending
+	h.pending = make(map[string]map[string]sample.Sample)
+	messages := make(map[string]string, len(pending))
+	for deviceID := range pending {
+		j, err := json.Marshal(h.devices[deviceID])
+		if err != nil {
+			h.mu.Unlock()
+			return err
+		}
+		messages[deviceID] = string(j)
+	}
+	h.mu.Unlock()
+
+	var flushErr error
+	for deviceID, samples := range pending {
+		err := h.flushDevice(ctx, deviceID, messages[deviceID], samples)
+		if err != nil && flushErr == nil {
+			flushErr = err
+		}
+	}
+	if flushErr != nil {
+		return flushErr
+	}
+
+	return h.publishManifest(ctx)
+}
+
+// flushDevice will publish the discovery message of the device and the states of its new components
+func (h *HomeAssistant) flushDevice(ctx context.Context, deviceID, message string, samples map[string]sample.Sample) error {
+	topic := h.deviceTopic(deviceID)
+	h.logger.Printf("Configuring device on topic %s with payload %s\n", topic, message)
+	err := h.sendMsg(ctx, topic, message)
+	if err != nil {
+		h.mu.Lock()
+		// queued again for the next flush, unless newer samples of the components were queued meanwhile
+		h.queue(deviceID, samples, false)
+		h.mu.Unlock()
+
+		return fmt.Errorf("could not send discovery of device %s: %w", deviceID, err)
+	}
+
+	h.mu.Lock()
+	for objectID, s := range samples {
+		h.alreadyConfigured[objectID] = s.Name
+	}
+	h.mu.Unlock()
+
+	for _, s := range samples {
+		h.own(s, topic)
+		if isEvent(s) {
+			// the event is not retained and publishing it again would trigger it twice
+			continue
+		}
+		value, err := state(s)
+		if err != nil {
+			return err
+		}
+		stateTopic, err := h.sampleTopic(s)
+		if err != nil {
+			return err
+		}
+		err = h.send(ctx, stateTopic, value, h.retainState(s))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h *HomeAssistant) deviceTopic(deviceID string) string {
+	return fmt.Sprintf("%s/device/%s/config", h.cfg.DiscoveryPrefix, deviceID)
+}
@@ -0,0 +1,88 @@
+package publisher
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/krzysztof-gzocha/prometheus2mqtt/config"
+	"github.com/krzysztof-gzocha/prometheus2mqtt/sample"
+)
+
+type lastPublished struct {
+	value string
+	at    time.Time
+}
+
+// OnChange will skip publishing values of metrics with only_on_change, which did not change since last publish
+type OnChange struct {
+	publisher Publisher
+	mu        sync.Mutex
+	last      map[string]lastPublished
+}
+
+func NewOnChange(publisher Publisher) *OnChange {
+	return &OnChange{
+		publisher: publisher,
+		last:      make(map[string]lastPublished),
+	}
+}
+
+func (o *OnChange) Publish(ctx context.Context, s sample.Sample) error {
+	if !s.Metric.OnlyOnChange || s.Sub != "" {
+		return o.publisher.Publish(ctx, s)
+	}
+
+	o.mu.Lock()
+	last, exists := o.last[s.Name]
+	o.mu.Unlock()
+
+	silence := s.Metric.MaxSilence
+	if exists && !changed(s.Metric, last.value, s.Value) && (silence == 0 || time.Since(last.at) < silence) {
+		return nil
+	}
+
+	err := o.publisher.Publish(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	o.mu.Lock()
+	o.last[s.Name] = lastPublished{value: s.Value, at: time.Now()}
+	o.mu.Unlock()
+
+	return nil
+}
+
+func (o *OnChange) PublishBridge(ctx context.Context, name, value string) error {
+	return o.publisher.PublishBridge(ctx, name, value)
+}
+
+func (o *OnChange) Flush(ctx context.Context, result sample.Result) error {
+	return o.publisher.Flush(ctx, result)
+}
+
+// changed will compare the values numerically when possible, ignoring changes within the deadband of the metric
+func changed(metric config.Metric, previous, current string) bool {
+	if previous == current {
+		return false
+	}
+
+	prev, errPrev := strconv.ParseFloat(previous, 64)
+	curr, errCurr := strconv.ParseFloat(current, 64)
+	if errPrev != nil || errCurr != nil {
+		return true
+	}
+
+	diff := math.Abs(curr - prev)
+	if metric.Deadband > 0 && diff <= metric.Deadband {
+		return false
+	}
+	if metric.DeadbandPercent > 0 && diff <= math.Abs(prev)*metric.DeadbandPercent/100 {
+		return false
+	}
+
+	return true
+}
@@ -2,15 +2,32 @@ package publisher
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/krzysztof-gzocha/prometheus2mqtt/config"
+	"github.com/krzysztof-gzocha/prometheus2mqtt/sample"
+)
+
+// AvailabilityTopic is the name of the bridge topic announcing if the bridge is online
+const AvailabilityTopic = "availability"
+
+// Payloads of availability topics
+const (
+	PayloadOnline  = "online"
+	PayloadOffline = "offline"
 )
 
 type Publisher interface {
-	Publish(ctx context.Context, name, value string) error
+	Publish(ctx context.Context, s sample.Sample) error
+	// PublishBridge will publish a retained message about the bridge itself on config.Mqtt.BridgeTopic
+	PublishBridge(ctx context.Context, name, value string) error
+	// Flush will publish all the messages buffered since the last flush, it is called after every scrape
+	// with its result, so the state of series not returned anymore can be dropped
+	Flush(ctx context.Context, result sample.Result) error
 }
 
 type Simple struct {
@@ -31,12 +48,52 @@ func NewSimple(
 	}
 }
 
-func (s *Simple) Publish(ctx context.Context, name, value string) error {
-	topic := s.cfg.PublishTopicPrefix + "/" + name
+func (s *Simple) Publish(ctx context.Context, smpl sample.Sample) error {
+	topic, templated, err := renderTopic(s.cfg, smpl)
+	if err != nil {
+		return err
+	}
+	if !templated {
+		topic = s.cfg.PublishTopicPrefix + "/" + smpl.Name
+		if smpl.Sub != "" {
+			topic += "/" + smpl.Sub
+		}
+	}
+
+	value := smpl.Value
+	if smpl.Sub == "" && s.cfg.PayloadFormat == config.PayloadJSON {
+		j, err := json.Marshal(newJSONPayload(smpl))
+		if err != nil {
+			return err
+		}
+		value = string(j)
+	}
+
+	return s.sendMsg(ctx, topic, value)
+}
+
+func (s *Simple) PublishBridge(ctx context.Context, name, value string) error {
+	return s.send(ctx, s.cfg.BridgeTopic(name), value, true)
+}
+
+func (s *Simple) Flush(_ context.Context, _ sample.Result) error {
+	return nil
+}
+
+func (s *Simple) sendMsg(ctx context.Context, topic, value string) error {
+	return s.send(ctx, topic, value, s.cfg.RetainMessages)
+}
+
+func (s *Simple) send(ctx context.Context, topic, value string, retained bool) error {
+	err := config.ValidateTopic(topic)
+	if err != nil {
+		return err
+	}
+
 	token := s.mqtt.Publish(
 		topic,
 		s.cfg.Qos,
-		s.cfg.RetainMessages,
+		retained,
 		value,
 	)
 
@@ -55,3 +112,25 @@ func (s *Simple) Publish(ctx context.Context, name, value string) error {
 		return fmt.Errorf("publishing exceeded timeout: %w", token.Error())
 	}
 }
+
+// jsonPayload is the message of a sample published with "json" payload format
+type jsonPayload struct {
+	// Value is a number, unless the value can not be represented as JSON number
+	Value     interface{}       `json:"value"`
+	Timestamp time.Time         `json:"timestamp"`
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels"`
+	Query     string            `json:"query"`
+}
+
+func newJSONPayload(s sample.Sample) jsonPayload {
+	attributes := s.Attributes()
+
+	return jsonPayload{
+		Value:     s.JSONValue(),
+		Timestamp: attributes.Timestamp,
+		Name:      s.Name,
+		Labels:    attributes.Labels,
+		Query:     attributes.Query,
+	}
+}
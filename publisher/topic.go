@@ -0,0 +1,53 @@
+package publisher
+
+import (
+	"bytes"
+	"regexp"
+
+	"github.com/krzysztof-gzocha/prometheus2mqtt/config"
+	"github.com/krzysztof-gzocha/prometheus2mqtt/sample"
+)
+
+// subReference matches templates placing the sub-topic themselves with .sub (but not e.g. .labels.sub)
+var subReference = regexp.MustCompile(`(^|[^.\w])\.sub\b`)
+
+// renderTopic will render the topic of the sample from the topic template of its metric or the global one.
+// The second value is false when no template is configured, in which case the default topic should be used.
+// Samples describing the metric as a whole (its error, diagnostics or availability) have no series labels,
+// so they are rendered only by templates using .sub, which are expected to work without labels.
+// Other templates would render the same topic for them as for the series, so they keep the default topic.
+func renderTopic(cfg config.Mqtt, s sample.Sample) (string, bool, error) {
+	tpl := s.Metric.Topic
+	if tpl == "" {
+		tpl = cfg.TopicTemplate
+	}
+	placesSub := subReference.MatchString(tpl)
+	if tpl == "" || (s.IsMetricLevel() && !placesSub) {
+		return "", false, nil
+	}
+
+	t, err := config.NewTemplate("topic").Option("missingkey=zero").Parse(tpl)
+	if err != nil {
+		return "", true, err
+	}
+
+	buf := bytes.Buffer{}
+	err = t.Execute(&buf, map[string]interface{}{
+		"name":      s.Name,
+		"id":        s.ID,
+		"labels":    s.Labels,
+		"client_id": cfg.ClientID,
+		"prefix":    cfg.PublishTopicPrefix,
+		"sub":       s.Sub,
+	})
+	if err != nil {
+		return "", true, err
+	}
+
+	topic := buf.String()
+	if s.Sub != "" && !placesSub {
+		topic += "/" + s.Sub
+	}
+
+	return topic, true, config.ValidateTopic(topic)
+}
@@ -0,0 +1,87 @@
+package sample
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/krzysztof-gzocha/prometheus2mqtt/config"
+)
+
+// Subs of auxiliary values published next to the metric
+const (
+	// SubHistory is used for samples carrying JSON history of range queries
+	SubHistory = "history"
+	// SubError is used for samples carrying the error of the failed query
+	SubError = "error"
+	// SubDiagnostics is used for samples carrying the warnings returned with the query result
+	SubDiagnostics = "diagnostics"
+	// SubAvailability is used for samples carrying the availability of the metric
+	SubAvailability = "availability"
+	// SubAttributes is used for JSON attributes of the sample: labels, timestamp and query
+	SubAttributes = "attributes"
+)
+
+// Sample is a single value scraped for a configured metric, ready to be published
+type Sample struct {
+	// Metric is the configuration of the metric, which produced the sample
+	Metric config.Metric
+	// ID is the rendered metric ID, stable identifier of the entity when the name changes
+	ID string
+	// Name is the rendered metric name, used to build the MQTT topic
+	Name string
+	// Sub is set for auxiliary values, which should be published on a sibling topic of the metric, e.g. "history"
+	Sub    string
+	Value  string
+	Labels map[string]string
+	// Timestamp is the time of the sample reported by the data source
+	Timestamp time.Time
+}
+
+// JSONValue will return the value as a number, unless it can not be represented as JSON number
+func (s Sample) JSONValue() interface{} {
+	v, err := strconv.ParseFloat(s.Value, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return s.Value
+	}
+
+	return v
+}
+
+// IsMetricLevel will return true for auxiliary values describing the metric as a whole instead of a single series
+func (s Sample) IsMetricLevel() bool {
+	return s.Sub == SubError || s.Sub == SubDiagnostics || s.Sub == SubAvailability
+}
+
+// Result is the outcome of scraping all the metrics
+type Result struct {
+	Samples []Sample
+	// Errors holds the error of every metric which could not be scraped, by metric name
+	Errors map[string]error
+	// Warnings holds the warnings returned by the data source, by metric name
+	Warnings map[string][]string
+	Stats    map[string]Stats
+}
+
+// Stats of querying a single metric
+type Stats struct {
+	Duration time.Duration
+	// Series is the number of samples created from the query result
+	Series int
+}
+
+// Attributes of the sample describing where its value comes from
+type Attributes struct {
+	Labels    map[string]string `json:"labels"`
+	Timestamp time.Time         `json:"timestamp"`
+	Query     string            `json:"query"`
+}
+
+// Attributes will return the labels, timestamp and query of the sample
+func (s Sample) Attributes() Attributes {
+	return Attributes{
+		Labels:    s.Labels,
+		Timestamp: s.Timestamp,
+		Query:     s.Metric.Query,
+	}
+}
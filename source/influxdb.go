@@ -0,0 +1,257 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/krzysztof-gzocha/prometheus2mqtt/config"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	fluxValue    = "_value"
+	fluxTime     = "_time"
+	fluxTable    = "table"
+	fluxResult   = "result"
+	fluxError    = "error"
+	fluxDatatype = "#datatype"
+	fluxString   = "string"
+)
+
+func init() {
+	Register(config.SourceInfluxDB, newInfluxDB)
+}
+
+// InfluxDB will run Flux queries against InfluxDB v2 API.
+// Every table of the result is one series labelled with its string columns (e.g. _measurement, _field and tags).
+// The query has to select its own time range, instant queries use the last row of each table,
+// while range queries return all of them to be reduced.
+type InfluxDB struct {
+	url    string
+	org    string
+	client *http.Client
+}
+
+type fluxRequest struct {
+	Query   string      `json:"query"`
+	Type    string      `json:"type"`
+	Dialect fluxDialect `json:"dialect"`
+}
+
+type fluxDialect struct {
+	Header      bool     `json:"header"`
+	Annotations []string `json:"annotations"`
+}
+
+type fluxResponseError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func newInfluxDB(source config.Source, url string, transport *http.Transport, _ *log.Logger) (Querier, error) {
+	if source.Org == "" {
+		return nil, errors.New("org is required by influxdb source")
+	}
+	rt, err := NewRoundTripper(source.Prometheus, "Token", transport)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewInfluxDB(url, source.Org, &http.Client{Transport: rt}), nil
+}
+
+// NewInfluxDB will create InfluxDB source querying the API at given URL in the name of given organization
+func NewInfluxDB(url, org string, client *http.Client) *InfluxDB {
+	return &InfluxDB{url: strings.TrimRight(url, "/"), org: org, client: client}
+}
+
+func (i *InfluxDB) Query(ctx context.Context, query string, _ time.Time) (model.Value, v1.Warnings, error) {
+	series, err := i.query(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	vector := make(model.Vector, 0, len(series))
+	for _, s := range series {
+		last := s.Values[len(s.Values)-1]
+		vector = append(vector, &model.Sample{Metric: s.Metric, Value: last.Value, Timestamp: last.Timestamp})
+	}
+
+	return vector, nil, nil
+}
+
+func (i *InfluxDB) QueryRange(ctx context.Context, query string, _ v1.Range) (model.Value, v1.Warnings, error) {
+	series, err := i.query(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return model.Matrix(series), nil, nil
+}
+
+func (i *InfluxDB) query(ctx context.Context, query string) ([]*model.SampleStream, error) {
+	body, err := json.Marshal(fluxRequest{
+		Query: query,
+		Type:  "flux",
+		Dialect: fluxDialect{
+			Header:      true,
+			Annotations: []string{"datatype", "group", "default"},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	u := i.url + "/api/v2/query?" + url.Values{"org": {i.org}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/csv")
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return nil, requestError(err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, requestError(err)
+	}
+	if resp.StatusCode/100 != 2 {
+		var fluxErr fluxResponseError
+		if json.Unmarshal(respBody, &fluxErr) == nil && fluxErr.Message != "" {
+			respBody = []byte(fluxErr.Message)
+		}
+
+		return nil, responseError(resp, respBody)
+	}
+
+	return parseFlux(respBody)
+}
+
+// parseFlux will convert annotated CSV into the series, one for each table of each result
+func parseFlux(body []byte) ([]*model.SampleStream, error) {
+	reader := csv.NewReader(bytes.NewReader(body))
+	reader.FieldsPerRecord = -1
+
+	var datatypes, header []string
+	series := make(map[string]*model.SampleStream)
+	keys := make([]string, 0)
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, &v1.Error{Type: v1.ErrBadResponse, Msg: err.Error()}
+		}
+
+		switch {
+		case len(record) == 0 || (len(record) == 1 && record[0] == ""):
+			// empty line separates tables with different columns, the annotations follow
+			header = nil
+		case record[0] == fluxDatatype:
+			datatypes = record
+			header = nil
+		case strings.HasPrefix(record[0], "#"):
+		case header == nil:
+			header = record
+		default:
+			s, key, err := fluxRow(datatypes, header, record)
+			if err != nil {
+				return nil, err
+			}
+			if existing, exists := series[key]; exists {
+				existing.Values = append(existing.Values, s.Values...)
+				continue
+			}
+			series[key] = s
+			keys = append(keys, key)
+		}
+	}
+
+	result := make([]*model.SampleStream, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, series[key])
+	}
+
+	return result, nil
+}
+
+// fluxRow will convert single row into the series with one value and return the key of its table
+func fluxRow(datatypes, header, record []string) (*model.SampleStream, string, error) {
+	s := &model.SampleStream{Metric: model.Metric{}}
+	var value model.SampleValue
+	timestamp := model.Now()
+	var resultName, table string
+	hasValue := false
+	for col, name := range header {
+		if col >= len(record) {
+			break
+		}
+		cell := record[col]
+		switch name {
+		case fluxError:
+			if cell != "" {
+				return nil, "", &v1.Error{Type: v1.ErrBadData, Msg: cell}
+			}
+		case fluxResult:
+			resultName = cell
+		case fluxTable:
+			table = cell
+		case fluxValue:
+			v, err := fluxNumber(cell)
+			if err != nil {
+				return nil, "", &v1.Error{Type: v1.ErrBadData, Msg: fmt.Sprintf("_value %q is not a number", cell)}
+			}
+			value = v
+			hasValue = true
+		case fluxTime:
+			t, err := time.Parse(time.RFC3339Nano, cell)
+			if err != nil {
+				return nil, "", &v1.Error{Type: v1.ErrBadResponse, Msg: err.Error()}
+			}
+			timestamp = model.TimeFromUnixNano(t.UnixNano())
+		case "":
+		default:
+			if col < len(datatypes) && datatypes[col] == fluxString {
+				s.Metric[model.LabelName(name)] = model.LabelValue(cell)
+			}
+		}
+	}
+	if !hasValue {
+		return nil, "", &v1.Error{Type: v1.ErrBadData, Msg: "result has no _value column"}
+	}
+
+	s.Values = []model.SamplePair{{Timestamp: timestamp, Value: value}}
+
+	return s, resultName + "/" + table + "/" + s.Metric.Fingerprint().String(), nil
+}
+
+// fluxNumber will parse numeric or boolean value
+func fluxNumber(cell string) (model.SampleValue, error) {
+	switch cell {
+	case "true":
+		return 1, nil
+	case "false":
+		return 0, nil
+	}
+	v, err := strconv.ParseFloat(cell, 64)
+
+	return model.SampleValue(v), err
+}
@@ -0,0 +1,227 @@
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/krzysztof-gzocha/prometheus2mqtt/config"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// fluxTables is annotated CSV with two results, the first one having two tables
+const fluxTables = "#datatype,string,long,dateTime:RFC3339,dateTime:RFC3339,dateTime:RFC3339,double,string,string,string,long\r\n" +
+	"#group,false,false,true,true,false,false,true,true,true,false\r\n" +
+	"#default,temperature,,,,,,,,,\r\n" +
+	",result,table,_start,_stop,_time,_value,_field,_measurement,room,sensor\r\n" +
+	",,0,2021-10-10T09:00:00Z,2021-10-10T10:00:00Z,2021-10-10T09:30:00Z,20.5,value,climate,kitchen,1\r\n" +
+	",,0,2021-10-10T09:00:00Z,2021-10-10T10:00:00Z,2021-10-10T10:00:00Z,21,value,climate,kitchen,1\r\n" +
+	",,1,2021-10-10T09:00:00Z,2021-10-10T10:00:00Z,2021-10-10T10:00:00Z,18.25,value,climate,bedroom,2\r\n" +
+	"\r\n" +
+	"#datatype,string,long,dateTime:RFC3339,boolean,string\r\n" +
+	"#group,false,false,false,false,true\r\n" +
+	"#default,door,,,,\r\n" +
+	",result,table,_time,_value,_field\r\n" +
+	",,0,2021-10-10T10:00:00Z,true,open\r\n" +
+	"\r\n"
+
+func fluxServer(t *testing.T, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v2/query" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if org := r.URL.Query().Get("org"); org != "home" {
+			t.Errorf("unexpected org %s", org)
+		}
+		var req fluxRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			t.Errorf("could not decode request: %s", err)
+		}
+		if req.Type != "flux" || req.Query == "" {
+			t.Errorf("unexpected request %+v", req)
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		_, _ = w.Write([]byte(body))
+	}))
+}
+
+func TestInfluxDBQueryRangeTables(t *testing.T) {
+	server := fluxServer(t, fluxTables)
+	defer server.Close()
+
+	val, _, err := NewInfluxDB(server.URL, "home", server.Client()).QueryRange(context.Background(), `from(bucket: "home")`, v1.Range{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	matrix, ok := val.(model.Matrix)
+	if !ok {
+		t.Fatalf("expected matrix, got %T", val)
+	}
+	if len(matrix) != 3 {
+		t.Fatalf("expected 3 series, got %d: %s", len(matrix), matrix)
+	}
+
+	kitchen := matrix[0]
+	expected := model.Metric{"_field": "value", "_measurement": "climate", "room": "kitchen"}
+	if !kitchen.Metric.Equal(expected) {
+		t.Errorf("expected labels %s, got %s", expected, kitchen.Metric)
+	}
+	if len(kitchen.Values) != 2 || kitchen.Values[0].Value != 20.5 || kitchen.Values[1].Value != 21 {
+		t.Errorf("unexpected values %v", kitchen.Values)
+	}
+	if kitchen.Values[1].Timestamp != model.TimeFromUnix(time.Date(2021, 10, 10, 10, 0, 0, 0, time.UTC).Unix()) {
+		t.Errorf("unexpected timestamp %s", kitchen.Values[1].Timestamp)
+	}
+	if matrix[1].Metric["room"] != "bedroom" || len(matrix[1].Values) != 1 {
+		t.Errorf("unexpected second table %s", matrix[1])
+	}
+	if matrix[2].Metric["_field"] != "open" || matrix[2].Values[0].Value != 1 {
+		t.Errorf("unexpected table of second result %s", matrix[2])
+	}
+}
+
+func TestInfluxDBQueryLastRow(t *testing.T) {
+	server := fluxServer(t, fluxTables)
+	defer server.Close()
+
+	val, _, err := NewInfluxDB(server.URL, "home", server.Client()).Query(context.Background(), `from(bucket: "home")`, time.Time{})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	vector, ok := val.(model.Vector)
+	if !ok {
+		t.Fatalf("expected vector, got %T", val)
+	}
+	if len(vector) != 3 {
+		t.Fatalf("expected 3 samples, got %d", len(vector))
+	}
+	if vector[0].Metric["room"] != "kitchen" || vector[0].Value != 21 {
+		t.Errorf("expected last row of the table, got %s", vector[0])
+	}
+}
+
+func TestInfluxDBEmptyResult(t *testing.T) {
+	for name, body := range map[string]string{"no content": "", "empty line": "\r\n"} {
+		t.Run(name, func(t *testing.T) {
+			server := fluxServer(t, body)
+			defer server.Close()
+
+			val, _, err := NewInfluxDB(server.URL, "home", server.Client()).Query(context.Background(), `from(bucket: "home")`, time.Time{})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if vector, ok := val.(model.Vector); !ok || len(vector) != 0 {
+				t.Errorf("expected empty vector, got %v", val)
+			}
+		})
+	}
+}
+
+func TestInfluxDBTokenAuthorization(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "Token secret" {
+			t.Errorf("unexpected authorization %q", auth)
+		}
+	}))
+	defer server.Close()
+
+	querier, err := newInfluxDB(
+		config.Source{Org: "home", Prometheus: config.Prometheus{BearerToken: "secret"}},
+		server.URL,
+		http.DefaultTransport.(*http.Transport).Clone(),
+		log.New(io.Discard, "", 0),
+	)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	_, _, err = querier.Query(context.Background(), `from(bucket: "home")`, time.Time{})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestInfluxDBErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		errType v1.ErrorType
+		msg     string
+	}{
+		{
+			name:    "invalid query",
+			status:  http.StatusBadRequest,
+			body:    `{"code":"invalid","message":"compilation failed"}`,
+			errType: v1.ErrBadData,
+			msg:     "400 Bad Request: compilation failed",
+		},
+		{name: "server error", status: http.StatusInternalServerError, body: "internal", errType: v1.ErrServer},
+		{name: "unauthorized", status: http.StatusUnauthorized, body: `{"code":"unauthorized"}`, errType: v1.ErrClient},
+		{
+			name:    "error column",
+			status:  http.StatusOK,
+			body:    ",error,reference\r\n,runtime error: division by zero,\r\n",
+			errType: v1.ErrBadData,
+			msg:     "runtime error: division by zero",
+		},
+		{
+			name:    "string value",
+			status:  http.StatusOK,
+			body:    "#datatype,string,long,string\r\n,result,table,_value\r\n,,0,open\r\n",
+			errType: v1.ErrBadData,
+		},
+		{
+			name:    "no value",
+			status:  http.StatusOK,
+			body:    "#datatype,string,long,string\r\n,result,table,host\r\n,,0,nas\r\n",
+			errType: v1.ErrBadData,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(test.status)
+				_, _ = w.Write([]byte(test.body))
+			}))
+			defer server.Close()
+
+			_, _, err := NewInfluxDB(server.URL, "home", server.Client()).Query(context.Background(), "bad", time.Time{})
+			var apiErr *v1.Error
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("expected API error, got %v", err)
+			}
+			if apiErr.Type != test.errType {
+				t.Errorf("expected %s error, got %s", test.errType, apiErr.Type)
+			}
+			if test.msg != "" && apiErr.Msg != test.msg {
+				t.Errorf("expected message %q, got %q", test.msg, apiErr.Msg)
+			}
+		})
+	}
+}
+
+func TestInfluxDBTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, _, err := NewInfluxDB(server.URL, "home", server.Client()).Query(ctx, `from(bucket: "home")`, time.Time{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected exceeded deadline, got %v", err)
+	}
+}
@@ -0,0 +1,344 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/krzysztof-gzocha/prometheus2mqtt/config"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/textparse"
+	"github.com/prometheus/prometheus/model/timestamp"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+const acceptHeader = "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5,*/*;q=0.1"
+
+// targetErrorLogInterval limits how often the error of the same failing target is logged
+const targetErrorLogInterval = 10 * time.Minute
+
+func init() {
+	Register(config.SourceLocal, newLocal)
+}
+
+// Local will scrape /metrics endpoints of the exporters on its own, keep the samples in memory for the retention
+// and evaluate PromQL queries locally, so no Prometheus server is needed.
+// Every target gets job label with the source name, instance label with its host and port, and `up` series.
+type Local struct {
+	job       string
+	targets   []string
+	interval  time.Duration
+	retention time.Duration
+	client    *http.Client
+	engine    *promql.Engine
+	storage   *memoryStorage
+	logger    *log.Logger
+
+	mu sync.Mutex
+	// failing holds the time when the error of each failing target was logged last time
+	failing map[string]time.Time
+}
+
+func newLocal(source config.Source, _ string, transport *http.Transport, logger *log.Logger) (Querier, error) {
+	for _, target := range source.Targets {
+		_, err := url.Parse(target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target %s: %w", target, err)
+		}
+	}
+	rt, err := NewRoundTripper(source.Prometheus, "Bearer", transport)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewLocal(
+		source.Name,
+		source.Targets,
+		source.GetScrapeInterval(),
+		source.GetRetention(),
+		&http.Client{Transport: rt},
+		logger,
+	), nil
+}
+
+// NewLocal will create Local source scraping targets every interval and keeping the samples for the retention
+func NewLocal(
+	job string,
+	targets []string,
+	interval, retention time.Duration,
+	client *http.Client,
+	logger *log.Logger,
+) *Local {
+	engine := promql.NewEngine(promql.EngineOpts{
+		MaxSamples: 50000000,
+		Timeout:    2 * time.Minute,
+		NoStepSubqueryIntervalFn: func(int64) int64 {
+			return interval.Milliseconds()
+		},
+	})
+
+	return &Local{
+		job:       job,
+		targets:   targets,
+		interval:  interval,
+		retention: retention,
+		client:    client,
+		engine:    engine,
+		storage:   newMemoryStorage(),
+		logger:    logger,
+		failing:   make(map[string]time.Time),
+	}
+}
+
+// Run will scrape all the targets every interval until ctx is done
+func (l *Local) Run(ctx context.Context) {
+	t := time.NewTicker(l.interval)
+	defer t.Stop()
+
+	for {
+		l.Scrape(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Scrape will scrape all the targets at once and remove the samples older than the retention
+func (l *Local) Scrape(ctx context.Context) {
+	now := time.Now()
+	wg := sync.WaitGroup{}
+	for _, target := range l.targets {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			l.scrapeTarget(ctx, target, now)
+		}(target)
+	}
+	wg.Wait()
+
+	l.storage.truncate(timestamp.FromTime(now.Add(-l.retention)))
+}
+
+func (l *Local) scrapeTarget(ctx context.Context, target string, now time.Time) {
+	instance := target
+	if u, err := url.Parse(target); err == nil {
+		instance = u.Host
+	}
+	ts := timestamp.FromTime(now)
+	samples, err := l.fetch(ctx, target, ts)
+	l.logTargetError(target, err, now)
+	up := 1.0
+	if err != nil {
+		// like in Prometheus the failure is exposed with up series only
+		up = 0
+		samples = nil
+	}
+
+	for i := range samples {
+		samples[i].labels = l.targetLabels(samples[i].labels, instance)
+	}
+	samples = append(samples, scrapedSample{
+		labels: labels.FromStrings(labels.MetricName, "up", "job", l.job, "instance", instance),
+		t:      ts,
+		v:      up,
+	})
+
+	l.storage.appendScrape(target, samples, ts)
+}
+
+// logTargetError will log the error of the target when it starts failing and then at most once per targetErrorLogInterval,
+// so the log is not flooded every scrape interval by the target which is down
+func (l *Local) logTargetError(target string, err error, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	logged, failing := l.failing[target]
+	if err == nil {
+		if failing {
+			delete(l.failing, target)
+			l.logger.Printf("Target %s of local source %s is up again\n", target, l.job)
+		}
+		return
+	}
+	if failing && now.Sub(logged) < targetErrorLogInterval {
+		return
+	}
+
+	l.failing[target] = now
+	l.logger.Printf("[ERROR] Could not scrape target %s of local source %s: %s\n", target, l.job, err.Error())
+}
+
+// targetLabels will add job and instance labels, keeping the ones exposed by the exporter with "exported_" prefix
+func (l *Local) targetLabels(lset labels.Labels, instance string) labels.Labels {
+	b := labels.NewBuilder(lset)
+	for name, value := range map[string]string{"job": l.job, "instance": instance} {
+		if exported := lset.Get(name); exported != "" {
+			b.Set("exported_"+name, exported)
+		}
+		b.Set(name, value)
+	}
+
+	return b.Labels()
+}
+
+func (l *Local) fetch(ctx context.Context, target string, ts int64) ([]scrapedSample, error) {
+	ctx, cancel := context.WithTimeout(ctx, l.interval)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", acceptHeader)
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("target %s responded with %s", target, resp.Status)
+	}
+
+	return parseExposition(body, resp.Header.Get("Content-Type"), ts)
+}
+
+// parseExposition will parse text or OpenMetrics format, the samples without explicit timestamp get the scrape time
+func parseExposition(body []byte, contentType string, ts int64) ([]scrapedSample, error) {
+	p, err := textparse.New(body, contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	samples := make([]scrapedSample, 0)
+	for {
+		entry, err := p.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if entry != textparse.EntrySeries {
+			continue
+		}
+
+		_, explicitTs, v := p.Series()
+		var lset labels.Labels
+		p.Metric(&lset)
+		t := ts
+		if explicitTs != nil {
+			t = *explicitTs
+		}
+		samples = append(samples, scrapedSample{labels: lset, t: t, v: v})
+	}
+
+	return samples, nil
+}
+
+func (l *Local) Query(ctx context.Context, query string, ts time.Time) (model.Value, v1.Warnings, error) {
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	q, err := l.engine.NewInstantQuery(l.storage, nil, query, ts)
+	if err != nil {
+		return nil, nil, &v1.Error{Type: v1.ErrBadData, Msg: err.Error()}
+	}
+
+	return l.exec(ctx, q)
+}
+
+func (l *Local) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, v1.Warnings, error) {
+	q, err := l.engine.NewRangeQuery(l.storage, nil, query, r.Start, r.End, r.Step)
+	if err != nil {
+		return nil, nil, &v1.Error{Type: v1.ErrBadData, Msg: err.Error()}
+	}
+
+	return l.exec(ctx, q)
+}
+
+func (l *Local) exec(ctx context.Context, q promql.Query) (model.Value, v1.Warnings, error) {
+	defer q.Close()
+
+	res := q.Exec(ctx)
+	warnings := make(v1.Warnings, 0, len(res.Warnings))
+	for _, w := range res.Warnings {
+		warnings = append(warnings, w.Error())
+	}
+	if res.Err != nil {
+		errType := v1.ErrExec
+		switch res.Err.(type) {
+		case promql.ErrQueryCanceled:
+			errType = v1.ErrCanceled
+		case promql.ErrQueryTimeout:
+			errType = v1.ErrTimeout
+		}
+
+		return nil, warnings, &v1.Error{Type: errType, Msg: res.Err.Error()}
+	}
+
+	return modelValue(res.Value), warnings, nil
+}
+
+// modelValue will convert the result of PromQL engine into the same types as returned by Prometheus API client
+func modelValue(val parser.Value) model.Value {
+	switch v := val.(type) {
+	case promql.Vector:
+		vector := make(model.Vector, 0, len(v))
+		for _, s := range v {
+			vector = append(vector, &model.Sample{
+				Metric:    modelMetric(s.Metric),
+				Value:     model.SampleValue(s.V),
+				Timestamp: model.Time(s.T),
+			})
+		}
+
+		return vector
+	case promql.Matrix:
+		matrix := make(model.Matrix, 0, len(v))
+		for _, s := range v {
+			ss := &model.SampleStream{Metric: modelMetric(s.Metric), Values: make([]model.SamplePair, 0, len(s.Points))}
+			for _, p := range s.Points {
+				ss.Values = append(ss.Values, model.SamplePair{Timestamp: model.Time(p.T), Value: model.SampleValue(p.V)})
+			}
+			matrix = append(matrix, ss)
+		}
+
+		return matrix
+	case promql.Scalar:
+		return &model.Scalar{Value: model.SampleValue(v.V), Timestamp: model.Time(v.T)}
+	case promql.String:
+		return &model.String{Value: v.V, Timestamp: model.Time(v.T)}
+	}
+
+	return nil
+}
+
+func modelMetric(lset labels.Labels) model.Metric {
+	metric := make(model.Metric, len(lset))
+	for _, l := range lset {
+		metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+	}
+
+	return metric
+}
+
+// staleMarker is the value marking the series, which disappeared from the target, as no longer present
+var staleMarker = math.Float64frombits(value.StaleNaN)
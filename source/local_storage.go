@@ -0,0 +1,205 @@
+package source
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/tsdbutil"
+)
+
+type scrapedSample struct {
+	labels labels.Labels
+	t      int64
+	v      float64
+}
+
+func (s scrapedSample) T() int64   { return s.t }
+func (s scrapedSample) V() float64 { return s.v }
+
+type memorySeries struct {
+	labels  labels.Labels
+	samples []tsdbutil.Sample
+}
+
+// memoryStorage keeps the scraped samples in memory and serves them to PromQL engine
+type memoryStorage struct {
+	mu     sync.RWMutex
+	series map[uint64]*memorySeries
+	// targets hold the series of the last scrape of each target, so the missing ones are marked as stale
+	targets map[string]map[uint64]struct{}
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{
+		series:  make(map[uint64]*memorySeries),
+		targets: make(map[string]map[uint64]struct{}),
+	}
+}
+
+// appendScrape will store the samples of single scrape and mark the series missing since the previous one as stale
+func (m *memoryStorage) appendScrape(target string, samples []scrapedSample, ts int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	scraped := make(map[uint64]struct{}, len(samples))
+	for _, s := range samples {
+		hash := s.labels.Hash()
+		scraped[hash] = struct{}{}
+		m.append(hash, s)
+	}
+
+	for hash := range m.targets[target] {
+		if _, exists := scraped[hash]; !exists {
+			if series, exists := m.series[hash]; exists {
+				m.append(hash, scrapedSample{labels: series.labels, t: ts, v: staleMarker})
+			}
+		}
+	}
+	m.targets[target] = scraped
+}
+
+func (m *memoryStorage) append(hash uint64, s scrapedSample) {
+	series, exists := m.series[hash]
+	if !exists {
+		series = &memorySeries{labels: s.labels}
+		m.series[hash] = series
+	}
+	if n := len(series.samples); n > 0 && series.samples[n-1].T() >= s.t {
+		// out of order or duplicated sample, e.g. exporter exposing the same explicit timestamp again
+		return
+	}
+	series.samples = append(series.samples, s)
+}
+
+// truncate will remove the samples older than mint and the series left without samples
+func (m *memoryStorage) truncate(mint int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for hash, series := range m.series {
+		i := sort.Search(len(series.samples), func(i int) bool {
+			return series.samples[i].T() >= mint
+		})
+		if i == len(series.samples) {
+			delete(m.series, hash)
+			continue
+		}
+		series.samples = append([]tsdbutil.Sample(nil), series.samples[i:]...)
+	}
+}
+
+func (m *memoryStorage) Querier(_ context.Context, mint, maxt int64) (storage.Querier, error) {
+	return &memoryQuerier{storage: m, mint: mint, maxt: maxt}, nil
+}
+
+type memoryQuerier struct {
+	storage    *memoryStorage
+	mint, maxt int64
+}
+
+// Select will return copy of matching series with the samples between mint and maxt
+func (q *memoryQuerier) Select(sortSeries bool, _ *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	q.storage.mu.RLock()
+	defer q.storage.mu.RUnlock()
+
+	set := &memorySeriesSet{index: -1}
+	for _, series := range q.storage.series {
+		if !matches(series.labels, matchers) {
+			continue
+		}
+		from := sort.Search(len(series.samples), func(i int) bool { return series.samples[i].T() >= q.mint })
+		to := sort.Search(len(series.samples), func(i int) bool { return series.samples[i].T() > q.maxt })
+		if from >= to {
+			continue
+		}
+		samples := append([]tsdbutil.Sample(nil), series.samples[from:to]...)
+		set.series = append(set.series, storage.NewListSeries(series.labels, samples))
+	}
+	if sortSeries {
+		sort.Slice(set.series, func(i, j int) bool {
+			return labels.Compare(set.series[i].Labels(), set.series[j].Labels()) < 0
+		})
+	}
+
+	return set
+}
+
+func (q *memoryQuerier) LabelValues(name string, matchers ...*labels.Matcher) ([]string, storage.Warnings, error) {
+	q.storage.mu.RLock()
+	defer q.storage.mu.RUnlock()
+
+	values := make(map[string]struct{})
+	for _, series := range q.storage.series {
+		if v := series.labels.Get(name); v != "" && matches(series.labels, matchers) {
+			values[v] = struct{}{}
+		}
+	}
+
+	return sortedKeys(values), nil, nil
+}
+
+func (q *memoryQuerier) LabelNames(matchers ...*labels.Matcher) ([]string, storage.Warnings, error) {
+	q.storage.mu.RLock()
+	defer q.storage.mu.RUnlock()
+
+	names := make(map[string]struct{})
+	for _, series := range q.storage.series {
+		if matches(series.labels, matchers) {
+			for _, l := range series.labels {
+				names[l.Name] = struct{}{}
+			}
+		}
+	}
+
+	return sortedKeys(names), nil, nil
+}
+
+func (q *memoryQuerier) Close() error {
+	return nil
+}
+
+type memorySeriesSet struct {
+	series []storage.Series
+	index  int
+}
+
+func (s *memorySeriesSet) Next() bool {
+	s.index++
+
+	return s.index < len(s.series)
+}
+
+func (s *memorySeriesSet) At() storage.Series {
+	return s.series[s.index]
+}
+
+func (s *memorySeriesSet) Err() error {
+	return nil
+}
+
+func (s *memorySeriesSet) Warnings() storage.Warnings {
+	return nil
+}
+
+func matches(lset labels.Labels, matchers []*labels.Matcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(lset.Get(m.Name)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,167 @@
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/krzysztof-gzocha/prometheus2mqtt/config"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+const lokiStreams = "streams"
+
+func init() {
+	Register(config.SourceLoki, newLoki)
+}
+
+// Loki will run LogQL metric queries, e.g. count_over_time({job="app"} |= "error" [1m]).
+// Log queries returning streams are not supported, as they have no numeric value.
+type Loki struct {
+	url    string
+	client *http.Client
+}
+
+type lokiResponse struct {
+	Status    string       `json:"status"`
+	ErrorType v1.ErrorType `json:"errorType"`
+	Error     string       `json:"error"`
+	Warnings  []string     `json:"warnings"`
+	Data      struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	} `json:"data"`
+}
+
+func newLoki(source config.Source, url string, transport *http.Transport, _ *log.Logger) (Querier, error) {
+	rt, err := NewRoundTripper(source.Prometheus, "Bearer", transport)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewLoki(url, &http.Client{Transport: rt}), nil
+}
+
+// NewLoki will create Loki source querying the API at given URL
+func NewLoki(url string, client *http.Client) *Loki {
+	return &Loki{url: strings.TrimRight(url, "/"), client: client}
+}
+
+func (l *Loki) Query(ctx context.Context, query string, ts time.Time) (model.Value, v1.Warnings, error) {
+	params := url.Values{"query": {query}}
+	if !ts.IsZero() {
+		params.Set("time", strconv.FormatInt(ts.UnixNano(), 10))
+	}
+
+	return l.get(ctx, "/loki/api/v1/query", params)
+}
+
+func (l *Loki) QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, v1.Warnings, error) {
+	params := url.Values{
+		"query": {query},
+		"start": {strconv.FormatInt(r.Start.UnixNano(), 10)},
+		"end":   {strconv.FormatInt(r.End.UnixNano(), 10)},
+		"step":  {strconv.FormatFloat(r.Step.Seconds(), 'f', -1, 64)},
+	}
+
+	return l.get(ctx, "/loki/api/v1/query_range", params)
+}
+
+func (l *Loki) get(ctx context.Context, path string, params url.Values) (model.Value, v1.Warnings, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.url+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, nil, requestError(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, requestError(err)
+	}
+	if err = responseError(resp, body); err != nil {
+		return nil, nil, err
+	}
+
+	var r lokiResponse
+	err = json.Unmarshal(body, &r)
+	if err != nil {
+		return nil, nil, &v1.Error{Type: v1.ErrBadResponse, Msg: err.Error()}
+	}
+	if r.Status == "error" {
+		return nil, r.Warnings, &v1.Error{Type: r.ErrorType, Msg: r.Error}
+	}
+
+	val, err := lokiValue(r.Data.ResultType, r.Data.Result)
+
+	return val, r.Warnings, err
+}
+
+func lokiValue(resultType string, result json.RawMessage) (model.Value, error) {
+	var val model.Value
+	switch resultType {
+	case model.ValVector.String():
+		val = &model.Vector{}
+	case model.ValMatrix.String():
+		val = &model.Matrix{}
+	case model.ValScalar.String():
+		val = &model.Scalar{}
+	case lokiStreams:
+		return nil, &v1.Error{Type: v1.ErrBadData, Msg: "log queries are not supported, use metric query, e.g. count_over_time"}
+	default:
+		return nil, &v1.Error{Type: v1.ErrBadResponse, Msg: fmt.Sprintf("unknown result type %q", resultType)}
+	}
+
+	err := json.Unmarshal(result, val)
+	if err != nil {
+		return nil, &v1.Error{Type: v1.ErrBadResponse, Msg: err.Error()}
+	}
+
+	switch v := val.(type) {
+	case *model.Vector:
+		return *v, nil
+	case *model.Matrix:
+		return *v, nil
+	}
+
+	return val, nil
+}
+
+// requestError will keep the context errors (e.g. exceeded timeout) detectable with errors.Is,
+// while other failures of the request are client errors, which are retried on replicas
+func requestError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return fmt.Errorf("request failed: %w", err)
+	}
+
+	return &v1.Error{Type: v1.ErrClient, Msg: err.Error()}
+}
+
+// responseError will turn unsuccessful HTTP status into the error, invalid queries are not retried on replicas
+func responseError(resp *http.Response, body []byte) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	errType := v1.ErrClient
+	switch {
+	case resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusUnprocessableEntity:
+		errType = v1.ErrBadData
+	case resp.StatusCode/100 == 5:
+		errType = v1.ErrServer
+	}
+
+	return &v1.Error{Type: errType, Msg: fmt.Sprintf("%s: %s", resp.Status, strings.TrimSpace(string(body)))}
+}
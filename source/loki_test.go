@@ -0,0 +1,158 @@
+package source
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+func TestLokiQueryVector(t *testing.T) {
+	ts := time.Unix(1633860000, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/loki/api/v1/query" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		if q := r.URL.Query().Get("query"); q != `count_over_time({job="app"}[1m])` {
+			t.Errorf("unexpected query %s", q)
+		}
+		if tm := r.URL.Query().Get("time"); tm != strconv.FormatInt(ts.UnixNano(), 10) {
+			t.Errorf("unexpected time %s", tm)
+		}
+		_, _ = w.Write([]byte(`{"status":"success","warnings":["slow"],"data":{"resultType":"vector","result":[
+			{"metric":{"job":"app"},"value":[1633860000,"5"]},
+			{"metric":{"job":"db"},"value":[1633860000.5,"1.5"]}
+		]}}`))
+	}))
+	defer server.Close()
+
+	val, warnings, err := NewLoki(server.URL+"/", server.Client()).Query(context.Background(), `count_over_time({job="app"}[1m])`, ts)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(warnings) != 1 || warnings[0] != "slow" {
+		t.Errorf("unexpected warnings %v", warnings)
+	}
+	vector, ok := val.(model.Vector)
+	if !ok {
+		t.Fatalf("expected vector, got %T", val)
+	}
+	if len(vector) != 2 {
+		t.Fatalf("expected 2 samples, got %d", len(vector))
+	}
+	if vector[0].Metric["job"] != "app" || vector[0].Value != 5 || vector[0].Timestamp != model.TimeFromUnix(1633860000) {
+		t.Errorf("unexpected first sample %s", vector[0])
+	}
+	if vector[1].Metric["job"] != "db" || vector[1].Value != 1.5 || vector[1].Timestamp != model.TimeFromUnixNano(1633860000500000000) {
+		t.Errorf("unexpected second sample %s", vector[1])
+	}
+}
+
+func TestLokiQueryRangeMatrix(t *testing.T) {
+	start := time.Unix(1633860000, 0)
+	end := start.Add(time.Minute)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/loki/api/v1/query_range" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		params := r.URL.Query()
+		if params.Get("start") != strconv.FormatInt(start.UnixNano(), 10) || params.Get("end") != strconv.FormatInt(end.UnixNano(), 10) {
+			t.Errorf("unexpected range %s - %s", params.Get("start"), params.Get("end"))
+		}
+		if params.Get("step") != "30" {
+			t.Errorf("unexpected step %s", params.Get("step"))
+		}
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[
+			{"metric":{"job":"app"},"values":[[1633860000,"1"],[1633860030,"2"],[1633860060,"3"]]}
+		]}}`))
+	}))
+	defer server.Close()
+
+	val, _, err := NewLoki(server.URL, server.Client()).QueryRange(context.Background(), `rate({job="app"}[1m])`, v1.Range{
+		Start: start,
+		End:   end,
+		Step:  30 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	matrix, ok := val.(model.Matrix)
+	if !ok {
+		t.Fatalf("expected matrix, got %T", val)
+	}
+	if len(matrix) != 1 || len(matrix[0].Values) != 3 {
+		t.Fatalf("unexpected matrix %s", matrix)
+	}
+	if matrix[0].Metric["job"] != "app" || matrix[0].Values[2].Value != 3 {
+		t.Errorf("unexpected series %s", matrix[0])
+	}
+}
+
+func TestLokiErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		errType v1.ErrorType
+	}{
+		{name: "bad request", status: http.StatusBadRequest, body: "parse error", errType: v1.ErrBadData},
+		{name: "unprocessable", status: http.StatusUnprocessableEntity, body: "invalid", errType: v1.ErrBadData},
+		{name: "server error", status: http.StatusBadGateway, body: "bad gateway", errType: v1.ErrServer},
+		{name: "unauthorized", status: http.StatusUnauthorized, body: "no org id", errType: v1.ErrClient},
+		{
+			name:    "error status",
+			status:  http.StatusOK,
+			body:    `{"status":"error","errorType":"execution","error":"too many series"}`,
+			errType: v1.ErrExec,
+		},
+		{
+			name:    "log query",
+			status:  http.StatusOK,
+			body:    `{"status":"success","data":{"resultType":"streams","result":[]}}`,
+			errType: v1.ErrBadData,
+		},
+		{name: "invalid body", status: http.StatusOK, body: `{`, errType: v1.ErrBadResponse},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(test.status)
+				_, _ = w.Write([]byte(test.body))
+			}))
+			defer server.Close()
+
+			_, _, err := NewLoki(server.URL, server.Client()).Query(context.Background(), "up", time.Time{})
+			var apiErr *v1.Error
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("expected API error, got %v", err)
+			}
+			if apiErr.Type != test.errType {
+				t.Errorf("expected %s error, got %s", test.errType, apiErr.Type)
+			}
+		})
+	}
+}
+
+func TestLokiTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, _, err := NewLoki(server.URL, server.Client()).Query(ctx, "up", time.Time{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected exceeded deadline, got %v", err)
+	}
+}
@@ -0,0 +1,28 @@
+package source
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/krzysztof-gzocha/prometheus2mqtt/config"
+	"github.com/prometheus/client_golang/api"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+)
+
+func init() {
+	Register(config.SourcePrometheus, newPrometheus)
+}
+
+// newPrometheus will create the client of Prometheus HTTP API, also served by Thanos, Mimir or VictoriaMetrics
+func newPrometheus(source config.Source, url string, transport *http.Transport, _ *log.Logger) (Querier, error) {
+	rt, err := NewRoundTripper(source.Prometheus, "Bearer", transport)
+	if err != nil {
+		return nil, err
+	}
+	client, err := api.NewClient(api.Config{Address: url, RoundTripper: rt})
+	if err != nil {
+		return nil, err
+	}
+
+	return v1.NewAPI(client), nil
+}
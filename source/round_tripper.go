@@ -0,0 +1,53 @@
+package source
+
+import (
+	"net/http"
+
+	"github.com/krzysztof-gzocha/prometheus2mqtt/config"
+)
+
+// authRoundTripper will add configured headers and credentials to every request sent to the source
+type authRoundTripper struct {
+	cfg    config.Prometheus
+	scheme string
+	next   http.RoundTripper
+}
+
+// NewRoundTripper will return the transport sending requests with the authentication and TLS configured in cfg.
+// The token is sent with given authorization scheme, e.g. "Bearer".
+// Secrets are read from the files on every request, so rotated ones are used without restart.
+func NewRoundTripper(cfg config.Prometheus, scheme string, transport *http.Transport) (http.RoundTripper, error) {
+	tlsCfg, err := cfg.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsCfg
+
+	return &authRoundTripper{cfg: cfg, scheme: scheme, next: transport}, nil
+}
+
+func (a *authRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTripper should not modify the original request
+	req = req.Clone(req.Context())
+	for name, value := range a.cfg.Headers {
+		req.Header.Set(name, value)
+	}
+
+	if a.cfg.BasicAuth.IsSet() {
+		username, password, err := a.cfg.BasicAuth.Credentials()
+		if err != nil {
+			return nil, err
+		}
+		req.SetBasicAuth(username, password)
+	}
+
+	token, err := a.cfg.GetBearerToken()
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", a.scheme+" "+token)
+	}
+
+	return a.next.RoundTrip(req)
+}
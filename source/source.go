@@ -0,0 +1,108 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/krzysztof-gzocha/prometheus2mqtt/config"
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+// Querier runs the query of a metric against single data source URL.
+// Instant queries return model.Vector or model.Scalar, range queries model.Matrix.
+// Errors caused by the query itself should be *v1.Error with v1.ErrBadData type, so the replicas are not queried.
+type Querier interface {
+	Query(ctx context.Context, query string, ts time.Time) (model.Value, v1.Warnings, error)
+	QueryRange(ctx context.Context, query string, r v1.Range) (model.Value, v1.Warnings, error)
+}
+
+// Runner is implemented by the queriers, which have to work in the background, e.g. to scrape the exporters
+type Runner interface {
+	Run(ctx context.Context)
+}
+
+// Factory will create the Querier of given source URL, logger is used for errors not returned by queries
+type Factory func(source config.Source, url string, transport *http.Transport, logger *log.Logger) (Querier, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// Register will make the source type available for `type` of configured sources.
+// It panics when the type is registered twice, like database/sql drivers.
+func Register(sourceType string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	if _, exists := factories[sourceType]; exists {
+		panic("source type " + sourceType + " is already registered")
+	}
+	factories[sourceType] = factory
+}
+
+// Types will return sorted names of registered source types
+func Types() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	types := make([]string, 0, len(factories))
+	for t := range factories {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+
+	return types
+}
+
+// NewQueriers will create the queriers of every configured source, the primary one followed by the failover replicas.
+// Every URL gets its own transport created by newTransport.
+func NewQueriers(cfg config.Config, newTransport func() *http.Transport, logger *log.Logger) (map[string][]Querier, error) {
+	queriers := make(map[string][]Querier)
+	for _, source := range cfg.GetSources() {
+		factoriesMu.RLock()
+		factory, exists := factories[source.GetType()]
+		factoriesMu.RUnlock()
+		if !exists {
+			return nil, fmt.Errorf(
+				"unknown type %q of source %s, available types: %s",
+				source.Type,
+				source.Name,
+				strings.Join(Types(), ", "),
+			)
+		}
+
+		urls := source.URLs()
+		if source.URL == "" {
+			// sources without API, like local one, have single querier
+			urls = []string{""}
+		}
+		for _, url := range urls {
+			querier, err := factory(source, url, newTransport(), logger)
+			if err != nil {
+				return nil, fmt.Errorf("could not create client of source %s: %w", source.Name, err)
+			}
+			queriers[source.Name] = append(queriers[source.Name], querier)
+		}
+	}
+
+	return queriers, nil
+}
+
+// Run will start in the background every querier implementing Runner until ctx is done
+func Run(ctx context.Context, queriers map[string][]Querier) {
+	for _, qs := range queriers {
+		for _, q := range qs {
+			if runner, ok := q.(Runner); ok {
+				go runner.Run(ctx)
+			}
+		}
+	}
+}
@@ -2,15 +2,21 @@ package ticker
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"log"
+	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/krzysztof-gzocha/prometheus2mqtt/config"
 	"github.com/krzysztof-gzocha/prometheus2mqtt/publisher"
+	"github.com/krzysztof-gzocha/prometheus2mqtt/sample"
+	"github.com/robfig/cron/v3"
 )
 
 type Scraper interface {
-	Scrape(ctx context.Context, metric ...config.Metric) (map[string]string, error)
+	Scrape(ctx context.Context, metric ...config.Metric) sample.Result
 }
 
 type Ticker struct {
@@ -18,6 +24,37 @@ type Ticker struct {
 	scraper   Scraper
 	publisher publisher.Publisher
 	logger    *log.Logger
+
+	mu sync.Mutex
+	// published holds "<sub>/<metric name>" of auxiliary values, which are currently published
+	published map[string]struct{}
+	// statuses holds the status of every metric from its last scrape
+	statuses map[string]metricStatus
+	// availability holds last published availability of every metric
+	availability map[string]string
+	// owners hold the series which published on every "<object ID>/<sub>" first
+	owners map[string]owner
+
+	// snapshotMu is held while the snapshot is updated and published,
+	// so snapshots of groups scraped at the same time are not published out of order
+	snapshotMu sync.Mutex
+	// snapshot holds the current value of every series, by sample name
+	snapshot map[string]snapshotEntry
+	// snapshotErrors holds the error of every failed metric, by metric name
+	snapshotErrors map[string]string
+}
+
+// owner of the object ID is the series of the metric, which rendered it first
+type owner struct {
+	metric string
+	name   string
+}
+
+// group of metrics scraped on the same schedule
+type group struct {
+	description string
+	schedule    cron.Schedule
+	metrics     []config.Metric
 }
 
 func NewTicker(
@@ -31,26 +68,116 @@ func NewTicker(
 		scraper:   prometheus,
 		publisher: publisher,
 		logger:    logger,
+		published: make(map[string]struct{}),
+		statuses:  make(map[string]metricStatus),
+
+		availability:   make(map[string]string),
+		owners:         make(map[string]owner),
+		snapshot:       make(map[string]snapshotEntry),
+		snapshotErrors: make(map[string]string),
 	}
 }
 
+// Start will scrape every group of metrics on its own schedule until the context is done
 func (t *Ticker) Start(ctx context.Context) {
-	t.logger.Printf("Starting scraping for %d metric(s) every %s\n", len(t.cfg.Metrics), t.cfg.Interval.String())
-	ticker := time.NewTicker(t.cfg.Interval)
+	groups, err := t.groups()
+	if err != nil {
+		t.logger.Printf("[ERROR] Could not schedule scraping: %s\n", err.Error())
+		return
+	}
 
+	wg := sync.WaitGroup{}
+	for _, g := range groups {
+		t.logger.Printf("Starting scraping for %d metric(s) %s\n", len(g.metrics), g.description)
+		wg.Add(1)
+		go func(g group) {
+			defer wg.Done()
+			t.run(ctx, g)
+		}(g)
+	}
+
+	wg.Wait()
+	t.logger.Printf("Received signal to stop")
+}
+
+// groups will group the metrics by their schedule, keeping the order of the config
+func (t *Ticker) groups() ([]group, error) {
+	groups := make([]group, 0)
+	byKey := make(map[string]int)
+	for _, metric := range t.cfg.Metrics {
+		key := "every " + metric.GetInterval(t.cfg.Interval).String()
+		if metric.Cron != "" {
+			key = "at " + metric.Cron
+		}
+
+		i, exists := byKey[key]
+		if !exists {
+			schedule, err := t.schedule(metric)
+			if err != nil {
+				return nil, err
+			}
+			groups = append(groups, group{description: key, schedule: schedule})
+			i = len(groups) - 1
+			byKey[key] = i
+		}
+		groups[i].metrics = append(groups[i].metrics, metric)
+	}
+
+	return groups, nil
+}
+
+func (t *Ticker) schedule(metric config.Metric) (cron.Schedule, error) {
+	if metric.Cron != "" {
+		return cron.ParseStandard(metric.Cron)
+	}
+
+	return every(metric.GetInterval(t.cfg.Interval)), nil
+}
+
+// every is the schedule with constant interval, unlike cron.Every it does not round sub-second intervals up to 1s
+type every time.Duration
+
+func (e every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+func (t *Ticker) run(ctx context.Context, g group) {
+	next := g.schedule.Next(time.Now())
 	for {
+		timer := time.NewTimer(time.Until(next) + t.jitter())
 		select {
-		case <-ticker.C:
-			t.tick(ctx)
+		case <-timer.C:
+			t.tick(ctx, g.metrics)
+
+			now := time.Now()
+			following := g.schedule.Next(next)
+			// the run can start up to the jitter later, so only the runs which could not start even then are missed
+			if now.After(following.Add(t.cfg.Jitter)) {
+				t.logger.Printf(
+					"[WARN] Scraping %d metric(s) %s took longer than the schedule allows, skipping missed runs\n",
+					len(g.metrics),
+					g.description,
+				)
+				following = g.schedule.Next(now)
+			}
+			next = following
 		case <-ctx.Done():
-			t.logger.Printf("Received signal to stop")
-			ticker.Stop()
+			timer.Stop()
 			return
 		}
 	}
 }
 
-func (t *Ticker) tick(ctx context.Context) {
+// jitter will return random delay up to configured jitter, so the queries are not all sent at the same moment
+func (t *Ticker) jitter() time.Duration {
+	if t.cfg.Jitter <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(t.cfg.Jitter))) //nolint:gosec
+}
+
+func (t *Ticker) tick(ctx context.Context, metrics []config.Metric) {
 	defer func() {
 		e := recover()
 		if e != nil {
@@ -58,20 +185,307 @@ func (t *Ticker) tick(ctx context.Context) {
 		}
 	}()
 
-	ctxTimeout, cancel := context.WithTimeout(ctx, t.cfg.ScrapeTimeout)
-	metrics, err := t.scraper.Scrape(ctxTimeout, t.cfg.Metrics...)
-	cancel()
+	result := t.scraper.Scrape(ctx, metrics...)
+	t.publishAvailability(ctx, metrics, result)
+
+	for _, s := range t.ownSamples(metrics, result) {
+		err := t.publisher.Publish(ctx, s)
+		if err != nil {
+			t.logger.Printf("Error occurred when publishing metric %s: %s", s.Name, err.Error())
+		}
+	}
+	err := t.publisher.Flush(ctx, result)
+	if err != nil {
+		t.logger.Printf("Error occurred when flushing published metrics: %s", err.Error())
+	}
 
-	if err == context.DeadlineExceeded {
-		t.logger.Printf("Scraping metrics exceeded timeout: %s\n", t.cfg.ScrapeTimeout.String())
-	} else if err != nil {
-		t.logger.Printf("Error when scraping for metrics: %s\n", err.Error())
+	t.publishErrors(ctx, metrics, result.Errors)
+	t.publishWarnings(ctx, metrics, result.Warnings)
+	t.publishStatus(ctx, metrics, result)
+	if t.cfg.Mqtt.Snapshot {
+		t.publishSnapshot(ctx, metrics, result)
 	}
+}
 
-	for name, value := range metrics {
-		err := t.publisher.Publish(ctx, name, value)
+// ownSamples will skip the samples, which rendered the same object ID as another series, so they do not overwrite
+// each other. The object IDs of series not returned anymore by successful query are released.
+func (t *Ticker) ownSamples(metrics []config.Metric, result sample.Result) []sample.Sample {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	samples := result.Samples
+	owned := make([]sample.Sample, 0, len(samples))
+	seen := make(map[string]struct{}, len(samples))
+	for _, s := range samples {
+		key := t.cfg.Mqtt.ObjectID(s.ID) + "/" + s.Sub
+		o, exists := t.owners[key]
+		if exists && (o.metric != s.Metric.Name || o.name != s.Name) {
+			t.logger.Printf(
+				"[ERROR] Series %s of metric %s collides with series %s of metric %s on ID %s. Skipping it\n",
+				s.Name,
+				s.Metric.Name,
+				o.name,
+				o.metric,
+				key,
+			)
+			continue
+		}
+		t.owners[key] = owner{metric: s.Metric.Name, name: s.Name}
+		seen[key] = struct{}{}
+		owned = append(owned, s)
+	}
+
+	scraped := make(map[string]struct{}, len(metrics))
+	for _, metric := range metrics {
+		if _, failed := result.Errors[metric.Name]; !failed {
+			scraped[metric.Name] = struct{}{}
+		}
+	}
+	for key, o := range t.owners {
+		if _, exists := seen[key]; exists {
+			continue
+		}
+		if _, exists := scraped[o.metric]; exists {
+			delete(t.owners, key)
+		}
+	}
+
+	return owned
+}
+
+// publishAvailability will publish "offline" for metrics with availability, which failed or returned no data,
+// and "online" for the rest. The availability is published only when it changes.
+func (t *Ticker) publishAvailability(ctx context.Context, metrics []config.Metric, result sample.Result) {
+	for _, metric := range metrics {
+		if !metric.Availability {
+			continue
+		}
+
+		availability := publisher.PayloadOnline
+		if _, failed := result.Errors[metric.Name]; failed || result.Stats[metric.Name].Series == 0 {
+			availability = publisher.PayloadOffline
+		}
+
+		t.mu.Lock()
+		unchanged := t.availability[metric.Name] == availability
+		t.mu.Unlock()
+		if unchanged {
+			continue
+		}
+
+		err := t.publisher.Publish(ctx, sample.Sample{
+			Metric: metric,
+			ID:     metric.BaseID(),
+			Name:   metric.BaseName(),
+			Sub:    sample.SubAvailability,
+			Value:  availability,
+		})
 		if err != nil {
-			t.logger.Printf("Error occurred when publishing metric %s: %s", name, err.Error())
+			t.logger.Printf("Error occurred when publishing availability of metric %s: %s", metric.Name, err.Error())
+			continue
 		}
+
+		t.mu.Lock()
+		t.availability[metric.Name] = availability
+		t.mu.Unlock()
+	}
+}
+
+// publishErrors will log and publish the error of every failed metric
+func (t *Ticker) publishErrors(ctx context.Context, metrics []config.Metric, scrapeErrors map[string]error) {
+	values := make(map[string]string, len(scrapeErrors))
+	for _, metric := range metrics {
+		err, failed := scrapeErrors[metric.Name]
+		if !failed {
+			continue
+		}
+
+		if errors.Is(err, context.DeadlineExceeded) {
+			t.logger.Printf("Scraping metric %s exceeded timeout: %s\n", metric.Name, t.cfg.MetricTimeout(metric).String())
+		} else {
+			t.logger.Printf("Error when scraping for metric %s: %s\n", metric.Name, err.Error())
+		}
+		values[metric.Name] = err.Error()
+	}
+
+	t.publishAuxiliary(ctx, metrics, sample.SubError, values)
+}
+
+// publishWarnings will publish the warnings returned with the query result of every metric as JSON array
+func (t *Ticker) publishWarnings(ctx context.Context, metrics []config.Metric, warnings map[string][]string) {
+	values := make(map[string]string, len(warnings))
+	for name, w := range warnings {
+		j, err := json.Marshal(w)
+		if err != nil {
+			t.logger.Printf("Could not encode warnings of metric %s: %s\n", name, err.Error())
+			continue
+		}
+		values[name] = string(j)
+	}
+
+	t.publishAuxiliary(ctx, metrics, sample.SubDiagnostics, values)
+}
+
+// publishAuxiliary will publish the values on sub-topic of each metric.
+// Value of the metric which is not present anymore is cleared by publishing an empty value.
+func (t *Ticker) publishAuxiliary(ctx context.Context, metrics []config.Metric, sub string, values map[string]string) {
+	for _, metric := range metrics {
+		key := sub + "/" + metric.Name
+		value, present := values[metric.Name]
+		if !present && !t.isPublished(key) {
+			continue
+		}
+
+		err := t.publisher.Publish(ctx, sample.Sample{
+			Metric: metric,
+			ID:     metric.BaseID(),
+			Name:   metric.BaseName(),
+			Sub:    sub,
+			Value:  value,
+		})
+		if err != nil {
+			t.logger.Printf("Error occurred when publishing %s of metric %s: %s", sub, metric.Name, err.Error())
+			continue
+		}
+
+		t.setPublished(key, present)
+	}
+}
+
+func (t *Ticker) isPublished(key string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, exists := t.published[key]
+
+	return exists
+}
+
+func (t *Ticker) setPublished(key string, published bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if published {
+		t.published[key] = struct{}{}
+	} else {
+		delete(t.published, key)
+	}
+}
+
+type status struct {
+	Time    time.Time               `json:"time"`
+	Metrics map[string]metricStatus `json:"metrics"`
+}
+
+type metricStatus struct {
+	Time     time.Time `json:"time"`
+	Series   int       `json:"series"`
+	Duration string    `json:"duration"`
+	Error    string    `json:"error,omitempty"`
+	Warnings []string  `json:"warnings,omitempty"`
+}
+
+// publishStatus will publish the summary of the last scrape of every metric on the bridge status topic
+func (t *Ticker) publishStatus(ctx context.Context, metrics []config.Metric, result sample.Result) {
+	now := time.Now()
+	t.mu.Lock()
+	for _, metric := range metrics {
+		ms := metricStatus{
+			Time:     now,
+			Series:   result.Stats[metric.Name].Series,
+			Duration: result.Stats[metric.Name].Duration.String(),
+			Warnings: result.Warnings[metric.Name],
+		}
+		if err, failed := result.Errors[metric.Name]; failed {
+			ms.Error = err.Error()
+		}
+		t.statuses[metric.Name] = ms
+	}
+	j, err := json.Marshal(&status{Time: now, Metrics: t.statuses})
+	t.mu.Unlock()
+	if err != nil {
+		t.logger.Printf("Could not encode bridge status: %s\n", err.Error())
+		return
+	}
+
+	err = t.publisher.PublishBridge(ctx, "status", string(j))
+	if err != nil {
+		t.logger.Printf("Error occurred when publishing bridge status: %s", err.Error())
+	}
+}
+
+type snapshot struct {
+	Time    time.Time                `json:"time"`
+	Metrics map[string]snapshotEntry `json:"metrics"`
+	// Errors are kept apart from Metrics, so the name of failed metric can not collide with the name of a series
+	Errors map[string]string `json:"errors"`
+}
+
+type snapshotEntry struct {
+	// metric is the name of configured metric, which produced the value
+	metric    string
+	Value     interface{} `json:"value"`
+	Timestamp time.Time   `json:"timestamp"`
+	Status    string      `json:"status"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// Statuses of values in the snapshot
+const (
+	snapshotOK    = "ok"
+	snapshotError = "error"
+)
+
+// publishSnapshot will update the snapshot with the result and publish the current values of all the metrics as single message.
+// Values of failed metrics are kept with the error status, while series not returned anymore are removed.
+func (t *Ticker) publishSnapshot(ctx context.Context, metrics []config.Metric, result sample.Result) {
+	t.snapshotMu.Lock()
+	defer t.snapshotMu.Unlock()
+
+	fresh := make(map[string]struct{}, len(result.Samples))
+	for _, s := range result.Samples {
+		if s.Sub != "" {
+			continue
+		}
+		fresh[s.Name] = struct{}{}
+		t.snapshot[s.Name] = snapshotEntry{
+			metric:    s.Metric.Name,
+			Value:     s.JSONValue(),
+			Timestamp: s.Timestamp,
+			Status:    snapshotOK,
+		}
+	}
+
+	for _, metric := range metrics {
+		err, failed := result.Errors[metric.Name]
+		if failed {
+			t.snapshotErrors[metric.Name] = err.Error()
+		} else {
+			delete(t.snapshotErrors, metric.Name)
+		}
+		for name, entry := range t.snapshot {
+			if entry.metric != metric.Name {
+				continue
+			}
+			if _, exists := fresh[name]; exists {
+				continue
+			}
+			if !failed {
+				delete(t.snapshot, name)
+				continue
+			}
+			entry.Status = snapshotError
+			entry.Error = err.Error()
+			t.snapshot[name] = entry
+		}
+	}
+
+	j, err := json.Marshal(&snapshot{Time: time.Now(), Metrics: t.snapshot, Errors: t.snapshotErrors})
+	if err != nil {
+		t.logger.Printf("Could not encode snapshot: %s\n", err.Error())
+		return
+	}
+
+	err = t.publisher.PublishBridge(ctx, "snapshot", string(j))
+	if err != nil {
+		t.logger.Printf("Error occurred when publishing snapshot: %s", err.Error())
 	}
 }